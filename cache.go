@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// repoUsage is the disk usage of one repo folder of the storage path, as reported by cache scan
+type repoUsage struct {
+	Repo       string   `json:"repo"` // folder name, the "/" of owner/name is stored as "_"
+	Path       string   `json:"path"`
+	Size       int64    `json:"size"`
+	Files      int      `json:"files"`
+	Incomplete []string `json:"incomplete,omitempty"` // parts and sidecars of interrupted downloads, relative to Path
+}
+
+// scanStorage walks every repo folder of the storage path, without any network call, largest first
+func scanStorage(storage string) ([]repoUsage, error) {
+	entries, err := os.ReadDir(storage)
+	if err != nil {
+		return nil, err
+	}
+	var repos []repoUsage
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		usage := repoUsage{Repo: entry.Name(), Path: filepath.Join(storage, entry.Name())}
+		err := filepath.WalkDir(usage.Path, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			usage.Size += info.Size()
+			usage.Files++
+			rel, _ := filepath.Rel(usage.Path, p)
+			if isIncomplete(rel) {
+				usage.Incomplete = append(usage.Incomplete, rel)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, usage)
+	}
+	sort.SliceStable(repos, func(i, j int) bool { return repos[i].Size > repos[j].Size })
+	return repos, nil
+}
+
+// isIncomplete reports whether a file is left over from an interrupted download: chunk parts and ETag sidecars live in tmp folders
+func isIncomplete(rel string) bool {
+	for _, dir := range strings.Split(filepath.Dir(rel), string(filepath.Separator)) {
+		if dir == "tmp" {
+			return true
+		}
+	}
+	ext := filepath.Ext(rel)
+	return ext == ".tmp" || ext == ".part" || ext == ".etag"
+}
+
+// runCacheScan prints the usage of the storage path as a table, or as JSON
+func runCacheScan(storage string, asJSON bool) error {
+	repos, err := scanStorage(storage)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		if repos == nil {
+			repos = []repoUsage{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(repos)
+	}
+
+	var total int64
+	fmt.Printf("%-50s %12s %8s %11s\n", "REPO", "SIZE", "FILES", "INCOMPLETE")
+	for _, r := range repos {
+		fmt.Printf("%-50s %12s %8d %11d\n", r.Repo, formatSize(r.Size), r.Files, len(r.Incomplete))
+		total += r.Size
+	}
+	fmt.Printf("\n%d repos, %s in %s\n", len(repos), formatSize(total), storage)
+	for _, r := range repos {
+		for _, f := range r.Incomplete {
+			fmt.Printf("incomplete: %s\n", filepath.Join(r.Repo, f))
+		}
+	}
+	return nil
+}
+
+// runClean deletes the tmp folders of interrupted downloads in the folders of a repo, -f filter folders included.
+// A tmp folder with a file modified less than minAge ago is kept, a download may still be writing to it
+func runClean(storage, repo string, minAge time.Duration) error {
+	repo, _, _ = strings.Cut(repo, ":")
+	repo, _ = splitRevision(repo)
+	folder := strings.Replace(repo, "/", "_", -1)
+	roots, err := filepath.Glob(filepath.Join(storage, folder+"_f_*"))
+	if err != nil {
+		return err
+	}
+	roots = append([]string{filepath.Join(storage, folder)}, roots...)
+
+	var removed int
+	var freed int64
+	for _, root := range roots {
+		if _, err := os.Stat(root); err != nil {
+			continue
+		}
+		var tmpFolders []string
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && d.Name() == "tmp" {
+				tmpFolders = append(tmpFolders, p)
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, tmp := range tmpFolders {
+			files, size, newest, err := downloaderFiles(tmp)
+			if err != nil {
+				return err
+			}
+			if len(files) == 0 {
+				continue // a folder of the repo named tmp, not the downloader's
+			}
+			if time.Since(newest) < minAge {
+				fmt.Printf("in use, kept: %s\n", tmp)
+				continue
+			}
+			for _, file := range files {
+				if err := os.Remove(file); err != nil {
+					return err
+				}
+			}
+			removeEmptyFolders(tmp)
+			fmt.Printf("removed: %s (%s)\n", tmp, formatSize(size))
+			removed++
+			freed += size
+		}
+	}
+	fmt.Printf("\n%d tmp folders removed, %s freed\n", removed, formatSize(freed))
+	return nil
+}
+
+// downloaderFiles returns the part files and ETag sidecars the downloader left in a tmp folder, their total size and the newest modification,
+// nothing when there is no part at all, then the folder is not the downloader's
+func downloaderFiles(tmp string) (files []string, size int64, newest time.Time, err error) {
+	hasParts := false
+	err = filepath.WalkDir(tmp, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		part := isPartFile(d.Name())
+		if !part && filepath.Ext(d.Name()) != ".etag" {
+			return nil
+		}
+		hasParts = hasParts || part
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files = append(files, p)
+		size += info.Size()
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil || !hasParts {
+		return nil, 0, time.Time{}, err
+	}
+	return files, size, newest, nil
+}
+
+// isPartFile reports whether a file name is a part of a multipart download, "<file name>_<index>.tmp"
+func isPartFile(name string) bool {
+	base, ok := strings.CutSuffix(name, ".tmp")
+	if !ok {
+		return false
+	}
+	i := strings.LastIndex(base, "_")
+	if i < 0 {
+		return false
+	}
+	_, err := strconv.Atoi(base[i+1:])
+	return err == nil
+}
+
+// removeEmptyFolders removes folder and the folders below it that are left empty, deepest first, keeping any folder still holding a file
+func removeEmptyFolders(folder string) {
+	var folders []string
+	filepath.WalkDir(folder, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			folders = append(folders, p)
+		}
+		return nil
+	})
+	for i := len(folders) - 1; i >= 0; i-- {
+		os.Remove(folders[i]) // fails on a folder that is not empty, which is kept
+	}
+}
+
+// formatSize prints a byte count with binary units, the counterpart of parseSize
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
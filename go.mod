@@ -3,15 +3,15 @@ module github.com/bodaay/HuggingFaceModelDownloader
 go 1.20
 
 require (
+	github.com/fatih/color v1.16.0
 	github.com/joho/godotenv v1.5.1
 	github.com/spf13/cobra v1.7.0
+	golang.org/x/sys v0.14.0
 )
 
 require (
-	github.com/fatih/color v1.16.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	golang.org/x/sys v0.14.0 // indirect
 )
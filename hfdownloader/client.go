@@ -0,0 +1,191 @@
+package hfdownloader
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// CACertFile is a PEM bundle of extra root CAs trusted on top of the system ones, for private mirrors with an internal CA
+	CACertFile = ""
+	// InsecureSkipVerify disables TLS certificate verification, only meant for testing against a dev mirror
+	InsecureSkipVerify = false
+	// MaxConnsPerHost caps the connections to any one host across all parts, new requests wait for a free one, 0 means no cap
+	MaxConnsPerHost = 0
+	// InsecureHosts skips TLS certificate verification for these host names only, every other host is still verified
+	InsecureHosts []string
+	// HTTPClient, when set, sends every request of the downloader instead of the built in clients, e.g. for mTLS, a proxy or tracing,
+	// the TLS settings and MaxConnsPerHost above are then up to its transport
+	HTTPClient *http.Client
+
+	transportMu       sync.Mutex
+	transport         http.RoundTripper
+	transportSettings string
+)
+
+// hostTransport sends the requests to the insecure hosts through a transport not verifying certificates, and all others through a verifying one.
+// The decision is made per request, so a redirect from a mirror to huggingface.co is verified again.
+type hostTransport struct {
+	verified *http.Transport
+	insecure *http.Transport
+	hosts    map[string]bool
+}
+
+func (h *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if h.hosts[strings.ToLower(req.URL.Hostname())] {
+		return h.insecure.RoundTrip(req)
+	}
+	return h.verified.RoundTrip(req)
+}
+
+// NewHTTPClient returns a copy of HTTPClient if set, else a client honoring the package TLS settings, all the requests of the downloader go through it.
+// The copy shares the transport, and lets callers set CheckRedirect or Timeout without changing the client they were given
+func NewHTTPClient() (*http.Client, error) {
+	if HTTPClient != nil {
+		client := *HTTPClient
+		return &client, nil
+	}
+	t, err := sharedTransport()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{Transport: t}, nil
+}
+
+// newChunkClient returns a client with its own transport, so every chunk of a file gets its own connection instead of sharing one,
+// with MaxConnsPerHost the shared transport is used instead, as the cap only holds within a transport
+func newChunkClient() (*http.Client, error) {
+	if HTTPClient != nil {
+		client := *HTTPClient
+		return &client, nil
+	}
+	t, err := sharedTransport()
+	if err != nil {
+		return nil, err
+	}
+	if MaxConnsPerHost > 0 {
+		return &http.Client{Transport: t}, nil
+	}
+	if h, ok := t.(*hostTransport); ok {
+		return &http.Client{Transport: &hostTransport{verified: h.verified.Clone(), insecure: h.insecure.Clone(), hosts: h.hosts}}, nil
+	}
+	return &http.Client{Transport: t.(*http.Transport).Clone()}, nil
+}
+
+// sharedTransport builds the transport once, and again only when the TLS settings change
+func sharedTransport() (http.RoundTripper, error) {
+	transportMu.Lock()
+	defer transportMu.Unlock()
+
+	settings := fmt.Sprintf("%s|%t|%s|%d", CACertFile, InsecureSkipVerify, strings.Join(InsecureHosts, ","), MaxConnsPerHost)
+	if transport != nil && transportSettings == settings {
+		return transport, nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: InsecureSkipVerify}
+	if CACertFile != "" {
+		pem, err := os.ReadFile(CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in CA file: %s", CACertFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	t.MaxConnsPerHost = MaxConnsPerHost
+	transport, transportSettings = t, settings
+	if !InsecureSkipVerify && len(InsecureHosts) > 0 {
+		insecure := t.Clone()
+		insecure.TLSClientConfig.InsecureSkipVerify = true
+		hosts := make(map[string]bool, len(InsecureHosts))
+		for _, h := range InsecureHosts {
+			hosts[strings.ToLower(strings.TrimSpace(h))] = true
+		}
+		transport = &hostTransport{verified: t, insecure: insecure, hosts: hosts}
+	}
+	return transport, nil
+}
+
+// statusError turns a failed response into an error carrying the start of its body, which often says why (e.g. a gated repo),
+// the query string is left out of the URL as it holds the signature of CDN links
+func statusError(resp *http.Response) error {
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	target := ""
+	if resp.Request != nil && resp.Request.URL != nil {
+		u := *resp.Request.URL
+		u.RawQuery, u.User = "", nil
+		target = " from " + u.String()
+	}
+	body := strings.TrimSpace(string(snippet))
+	err := fmt.Errorf("\n%s", errorColor("Bad status ", resp.Status, target))
+	if body != "" {
+		err = fmt.Errorf("\n%s", errorColor("Bad status ", resp.Status, target, ": ", body))
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		return &RetryAfterError{Delay: retryAfter(resp), Err: err}
+	}
+	return err
+}
+
+// RetryAfterError is a 429 or 503 response, Delay is how long the server asked to wait before trying again, 0 when it did not say
+type RetryAfterError struct {
+	Delay time.Duration
+	Err   error
+}
+
+func (e *RetryAfterError) Error() string { return e.Err.Error() }
+func (e *RetryAfterError) Unwrap() error { return e.Err }
+
+// RetryDelay returns the wait the server asked for with Retry-After somewhere in the error chain, 0 if none
+func RetryDelay(err error) time.Duration {
+	var retryErr *RetryAfterError
+	if errors.As(err, &retryErr) {
+		return retryErr.Delay
+	}
+	return 0
+}
+
+// retryAfter parses the Retry-After header, either seconds or an HTTP date
+func retryAfter(resp *http.Response) time.Duration {
+	value := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
+
+// checkNotHTML catches a login or error page served with a 200 in place of the file, which would otherwise be saved as the file,
+// files that are HTML themselves are let through
+func checkNotHTML(resp *http.Response, fileName string) error {
+	if !strings.HasPrefix(strings.ToLower(resp.Header.Get("Content-Type")), "text/html") {
+		return nil
+	}
+	switch strings.ToLower(path.Ext(fileName)) {
+	case ".html", ".htm":
+		return nil
+	}
+	return fmt.Errorf("\n%s", errorColor("Got an HTML page instead of the file ", path.Base(fileName), ", likely a login or error page, check the token and the repo access"))
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package hfdownloader
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// FreeDiskSpace is not implemented on this platform
+func FreeDiskSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("free disk space check is not supported on %s", runtime.GOOS)
+}
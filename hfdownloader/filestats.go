@@ -0,0 +1,92 @@
+package hfdownloader
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FileStat is what happened to one file of the last DownloadModel call, for metrics, skipped files included
+type FileStat struct {
+	Path       string        `json:"path"` // path inside the repo
+	Local      string        `json:"local"`
+	Bytes      int64         `json:"bytes"`                 // received over the network, less than the file size when resumed, more when parts were fetched again
+	HTTPStatus int           `json:"http_status,omitempty"` // status of the last response carrying file data, 200 or 206
+	Elapsed    time.Duration `json:"elapsed"`               // download and verification
+	Retries    int           `json:"retries"`               // failed attempts of earlier runs of the file, and expired links refreshed
+	Multipart  bool          `json:"multipart"`
+	Skipped    bool          `json:"skipped"`
+	SkipReason string        `json:"skip_reason,omitempty"` // "up to date", "filtered" or "disk full"
+}
+
+// FileStats returns the stats of the files of the last DownloadModel call, in the order they were processed
+func FileStats() []FileStat {
+	return stats.files
+}
+
+// transfer gathers the network side of one file download, the download functions fill it in by output file name
+type transfer struct {
+	bytes     int64 // updated atomically, parts of a file run concurrently
+	status    int
+	multipart bool
+	refreshes int
+	etag      string // of the responses the data came from, as sent
+}
+
+var (
+	transferMu sync.Mutex
+	transfers  = map[string]*transfer{}
+	// fileAttempts counts the downloads started per local file, it outlives DownloadModel so a retried run sees the earlier attempts
+	fileAttempts = map[string]int{}
+)
+
+// trackTransfer runs fn on the transfer of the output file under the lock, creating it if needed
+func trackTransfer(outputFileName string, fn func(t *transfer)) {
+	transferMu.Lock()
+	defer transferMu.Unlock()
+	t := transfers[outputFileName]
+	if t == nil {
+		t = &transfer{}
+		transfers[outputFileName] = t
+	}
+	fn(t)
+}
+
+// transferFor returns the transfer of the output file, for the chunks to add their bytes to without the lock
+func transferFor(outputFileName string) *transfer {
+	var found *transfer
+	trackTransfer(outputFileName, func(t *transfer) { found = t })
+	return found
+}
+
+func (t *transfer) addBytes(n int64) {
+	atomic.AddInt64(&t.bytes, n)
+}
+
+// startFileStat counts a new attempt for the file and clears what an earlier attempt transferred
+func startFileStat(file hfmodel) time.Time {
+	transferMu.Lock()
+	defer transferMu.Unlock()
+	fileAttempts[file.AppendedPath]++
+	delete(transfers, file.AppendedPath)
+	return time.Now()
+}
+
+// finishFileStat records a file downloaded and verified since started
+func finishFileStat(file hfmodel, started time.Time) {
+	transferMu.Lock()
+	defer transferMu.Unlock()
+	stat := FileStat{Path: file.Path, Local: localPath(file), Elapsed: time.Since(started), Retries: fileAttempts[file.AppendedPath] - 1}
+	if t := transfers[file.AppendedPath]; t != nil {
+		stat.Bytes, stat.HTTPStatus, stat.Multipart = atomic.LoadInt64(&t.bytes), t.status, t.multipart
+		stat.Retries += t.refreshes
+	}
+	delete(fileAttempts, file.AppendedPath)
+	delete(transfers, file.AppendedPath)
+	stats.files = append(stats.files, stat)
+}
+
+// skipFileStat records a file that was not downloaded
+func skipFileStat(file hfmodel, reason string) {
+	stats.files = append(stats.files, FileStat{Path: file.Path, Local: localPath(file), Skipped: true, SkipReason: reason})
+}
@@ -1,20 +1,26 @@
 package hfdownloader
 
 import (
+	"bytes"
+	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
-	"math"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fatih/color"
@@ -29,6 +35,15 @@ const (
 	LfsDatasetResolverURL  = "https://huggingface.co/datasets/%s/resolve/%s/%s"
 	JsonModelsFileTreeURL  = "https://huggingface.co/api/models/%s/tree/%s/%s"
 	JsonDatasetFileTreeURL = "https://huggingface.co/api/datasets/%s/tree/%s/%s"
+	WhoAmIURL              = "https://huggingface.co/api/whoami-v2"
+)
+
+// defaults shared by the package vars below and the command line config, so the library and the CLI agree
+const (
+	DefaultNumConnections          = 5
+	DefaultOnExistingDifferentSize = "redownload"
+	DefaultVerifyExisting          = "lfs"
+	DefaultEndpoint                = "https://huggingface.co"
 )
 
 var (
@@ -36,11 +51,129 @@ var (
 	successColor   = color.New(color.FgHiGreen).SprintFunc()
 	warningColor   = color.New(color.FgYellow).SprintFunc()
 	errorColor     = color.New(color.FgRed).SprintFunc()
-	NumConnections = 5
+	NumConnections = DefaultNumConnections
 	RequiresAuth   = false
 	AuthToken      = ""
+	// Endpoint replaces the https://huggingface.co host of the URLs above, for mirrors like https://hf-mirror.com
+	Endpoint = DefaultEndpoint
+	// NumSplits is the number of parts a file is divided into, 0 means one part per connection
+	NumSplits = 0
+	// ProbeRanges downloads non-LFS files of at least ProbeRangesMinSize in parts like LFS files when the server supports ranges,
+	// it costs a HEAD request per such file, so it is off by default
+	ProbeRanges              = false
+	ProbeRangesMinSize int64 = 32 * 1024 * 1024
+	// RampUp opens the connections of a file one at a time, RampUpStep apart, instead of all at once, for networks choking on connection bursts
+	RampUp     = false
+	RampUpStep = 100 * time.Millisecond
+	// PartDirs spreads the part files of multipart downloads round-robin over these folders, e.g. on different disks, instead of the repo tmp folder
+	PartDirs []string
+	// OnExistingDifferentSize is what to do with an existing file whose size differs from the repo: "redownload", "resume", "skip" or "error"
+	OnExistingDifferentSize = DefaultOnExistingDifferentSize
+	// VerifyExisting is how files already on disk with the right size are checked before being skipped:
+	// "lfs" hashes LFS files (the verification mode rules apply), "all" hashes every file, "off" trusts the size
+	VerifyExisting = DefaultVerifyExisting
+	// Files, when set, are the exact repo paths to download, no other file is downloaded and the filters are ignored
+	Files      []string
+	filesFound map[string]bool
+	// ScanConcurrency is how many repo folders are listed at once before downloading, 0 uses NumConnections, 1 lists each folder when reached
+	ScanConcurrency = 0
+	treeMu          sync.Mutex
+	treeCache       map[string][]hfmodel // folder file lists fetched by prefetchTree, by tree URL
+	// Excludes are filter patterns (substring, glob or /regex/) of files never downloaded, applied before the filters and Includes,
+	// only Files are kept even when excluded
+	Excludes []string
+	// Includes, when set, is an allowlist of globs on the repo path, e.g. "onnx/*" or "config.json", files matching none are skipped.
+	// They add to Files, and are intersected with the filters
+	Includes []string
+	// SplitSets selects all the members of a split file set (model-00001-of-00003.gguf, .gguf-split-a, .z01, .part1, .001, ...) when a filter selects one of them,
+	// without it a set the filters only partly select is just warned about
+	SplitSets = false
+	// Layout is how files are laid out in the storage path, "" for <owner>_<repo>/<repo path>,
+	// or "filter-flat" for <filter>/<file name>, every filter in its own folder without the repo folder and the repo sub folders,
+	// or "hub" for the huggingface_hub cache: models--<owner>--<repo>/blobs, snapshots/<commit> linking to them, and refs/<branch>
+	Layout    = ""
+	flatNames map[string]string // file name to repo path of the current filter-flat folder, to catch two files with the same name
+	// RouteRules send the files matching a glob to a folder of their own, e.g. LoRAs to loras/, the first matching rule wins
+	RouteRules  []RouteRule
+	storageRoot string // the storage path of the current DownloadModel call, relative rule folders are in it
+	// StrictFilters applies the filters to every file, by default they only select which LFS files are downloaded
+	StrictFilters = false
+	// MatchFullPath matches the filters without a "/" against the whole repo path, instead of only the file name
+	MatchFullPath = false
+	filterRegexps map[string]*regexp.Regexp // compiled /regex/ filters, by pattern
+	// ScanRetries is how many times a failed tree request (network error, 5xx, truncated body) is tried before giving up
+	ScanRetries = 3
+	// AllowEmpty makes a download selecting no file at all a success instead of ErrNoFiles
+	AllowEmpty = false
+	// MaxTotalRetries aborts the run once this many retries happened in total, file list requests and download attempts together, 0 means no limit
+	MaxTotalRetries = 0
+	totalRetries    int64
+	// MinFreeBytes pauses before the next file while free disk space is below it, and LowDiskGracePeriod is how long to wait before giving up, 0 disables the check
+	MinFreeBytes       uint64 = 0
+	LowDiskGracePeriod        = 5 * time.Minute
+	// StopWhenFull stops downloading cleanly once the next file would not fit on the disk (keeping MinFreeBytes free), the remaining files are reported as skipped
+	StopWhenFull = false
+	// MaxDepth stops walking into folders whose files are deeper than it, root files are at depth 0, 0 means unlimited
+	MaxDepth = 0
+	// FileHook, when set, is called for each file before it is checked and downloaded, it can skip the file or change its destination, an error aborts the download
+	FileHook func(file RepoFile) (skip bool, newDst string, err error)
+	// Output receives the progress and messages of the downloader, e.g. os.Stderr to keep stdout for the results of a script
+	Output io.Writer = os.Stdout
+	// ShowPartProgress appends each part's percentage to the progress line, useful to spot a single slow part stalling a file
+	ShowPartProgress = false
+	// VerifyOverrides force a verification mode ("sha256", "size" or "etag") on files whose repo path matches the glob, in order, the first match wins
+	VerifyOverrides []VerifyOverride
+	// Prune deletes local files that are no longer present in the repo, PruneDryRun only prints them
+	Prune       = false
+	PruneDryRun = false
 )
 
+// partProgress is sent by every chunk goroutine, idx tells which part the bytes belong to
+type partProgress struct {
+	idx   int
+	bytes int64
+}
+
+// RouteRule puts the files whose repo path or file name matches the Match glob in Dir, relative to the storage path unless absolute
+type RouteRule struct {
+	Match string `json:"match"`
+	Dir   string `json:"dir"`
+}
+
+// VerifyOverride forces the verification mode of the files whose repo path matches the Match glob
+type VerifyOverride struct {
+	Match string `json:"match"`
+	Mode  string `json:"mode"` // "sha256", "size" or "etag"
+}
+
+// RepoFile describes a file about to be downloaded, as passed to FileHook and returned by ListModel
+type RepoFile struct {
+	Path        string `json:"path"` // path inside the repo
+	Size        int64  `json:"size"`
+	IsLFS       bool   `json:"is_lfs"`
+	Destination string `json:"destination,omitempty"` // local path the file will be written to
+}
+
+// downloadStats counts what happened to the files of the current DownloadModel call, downloaded and upToDate hold local paths
+type downloadStats struct {
+	downloaded []string
+	upToDate   []string
+	filtered   int
+	// scanRetries counts the file list requests that had to be repeated, a hint of how flaky the connection is
+	scanRetries int
+	// noSpace lists the files not downloaded because the disk was full, with StopWhenFull
+	noSpace []string
+	// files has a FileStat per file processed, see FileStats
+	files []FileStat
+}
+
+var stats downloadStats
+
+// LocalFiles returns the local paths of the files downloaded by the last DownloadModel call, and of the files that were already up to date
+func LocalFiles() (downloaded, upToDate []string) {
+	return stats.downloaded, stats.upToDate
+}
+
 type hfmodel struct {
 	Type          string `json:"type"`
 	Oid           string `json:"oid"`
@@ -55,6 +188,8 @@ type hfmodel struct {
 	SkipDownloading bool
 	FilterSkip      bool
 	DownloadLink    string
+	ResolverURL     string // the resolve URL DownloadLink was obtained from, to get a fresh signed link when it expires
+	ETag            string // of the response the file was downloaded from, normalized, for the etag verification mode
 	Lfs             *hflfs `json:"lfs,omitempty"`
 }
 
@@ -66,6 +201,53 @@ type hflfs struct {
 
 func DownloadModel(ModelDatasetName string, AppendFilterToPath bool, SkipSHA bool, IsDataset bool, DestinationBasePath string, ModelBranch string, concurrentConnections int, token string, silentMode bool) error {
 	NumConnections = concurrentConnections
+	switch OnExistingDifferentSize {
+	case "redownload", "resume", "skip", "error":
+	default:
+		return fmt.Errorf("unknown existing different size policy %q, use one of: redownload, resume, skip, error", OnExistingDifferentSize)
+	}
+	switch VerifyExisting {
+	case "off", "lfs", "all":
+	default:
+		return fmt.Errorf("unknown verify existing mode %q, use one of: off, lfs, all", VerifyExisting)
+	}
+	// a typo would silently turn verification off for the matching files
+	for _, override := range VerifyOverrides {
+		switch override.Mode {
+		case "sha256", "size", "etag":
+		default:
+			return fmt.Errorf("unknown verify mode %q for %q, use one of: sha256, size, etag", override.Mode, override.Match)
+		}
+		if _, err := path.Match(override.Match, ""); err != nil {
+			return fmt.Errorf("invalid verify override glob %q: %v", override.Match, err)
+		}
+	}
+	switch Layout {
+	case "":
+	case "filter-flat":
+		if !strings.Contains(ModelDatasetName, ":") {
+			return fmt.Errorf("the filter-flat layout needs filters, e.g. %s:q4_k_m", ModelDatasetName)
+		}
+		if Prune || PruneDryRun {
+			return fmt.Errorf("prune can't be used with the filter-flat layout, the folders don't mirror the repo")
+		}
+		AppendFilterToPath = true // one run per filter, like appending the filter to the folder
+	case "hub":
+		if AppendFilterToPath {
+			return fmt.Errorf("filter folders (-f) can't be used with the hub layout, a snapshot holds the whole selection")
+		}
+		if Prune || PruneDryRun {
+			return fmt.Errorf("prune can't be used with the hub layout, the snapshot folders only hold links")
+		}
+		if len(RouteRules) > 0 {
+			return fmt.Errorf("route rules can't be used with the hub layout, files must stay in the snapshot")
+		}
+	default:
+		return fmt.Errorf("unknown layout %q, use one of: filter-flat, hub", Layout)
+	}
+	if err := compileFilterRegexps(ModelDatasetName); err != nil {
+		return err
+	}
 
 	// make sure we dont include dataset filter within folder creation
 	modelP := ModelDatasetName
@@ -74,30 +256,72 @@ func DownloadModel(ModelDatasetName string, AppendFilterToPath bool, SkipSHA boo
 		modelP = strings.Split(ModelDatasetName, ":")[0]
 		HasFilter = true
 	}
+	// Go only lifts the 260 characters MAX_PATH limit of Windows for absolute paths
+	if absPath, err := filepath.Abs(DestinationBasePath); err == nil {
+		DestinationBasePath = absPath
+	}
+	storageRoot = DestinationBasePath
 	modelPath := path.Join(DestinationBasePath, strings.Replace(modelP, "/", "_", -1))
+	if Layout == "hub" {
+		modelPath = path.Join(DestinationBasePath, hubRepoFolder(modelP, IsDataset))
+	}
 	if token != "" {
 		RequiresAuth = true
 		AuthToken = token
 	}
+	if Layout == "hub" {
+		if err := prepareHubSnapshot(modelPath, modelP, IsDataset, ModelBranch); err != nil {
+			return err
+		}
+	}
 
+	stats = downloadStats{}
+	streamedMu.Lock()
+	streamedHashes = map[string]string{} // non-LFS files are never checked, and a failed run leaves entries behind
+	streamedMu.Unlock()
+	filesFound = map[string]bool{}
+	manifest = nil
+	JsonTreeVariable, AgreementURL := EndpointURL(JsonModelsFileTreeURL), fmt.Sprintf(EndpointURL(AgreementModelURL), modelP)
+	if IsDataset {
+		JsonTreeVariable, AgreementURL = EndpointURL(JsonDatasetFileTreeURL), fmt.Sprintf(EndpointURL(AgreementDatasetURL), modelP)
+	}
+	defer func() { treeCache = nil }()
+	if err := prefetchTree(JsonTreeVariable, modelP, ModelBranch, AgreementURL, filesRoot(), silentMode); err != nil {
+		return err
+	}
 	if HasFilter && AppendFilterToPath { // for this feature, I'll just simple re-run the script and apply one filter at a time
-		filters := strings.Split(strings.Split(ModelDatasetName, ":")[1], ",")
+		_, filterList, _ := strings.Cut(ModelDatasetName, ":")
+		filters := splitFilters(filterList)
+		// exclusions are not folders of their own, they apply to every filter folder
+		var exclusions []string
+		for _, ff := range filters {
+			if strings.HasPrefix(ff, "!") {
+				exclusions = append(exclusions, ff)
+			}
+		}
 		for _, ff := range filters {
+			if strings.HasPrefix(ff, "!") {
+				continue
+			}
 			// create folders
 
 			ffpath := fmt.Sprintf("%s_f_%s", modelPath, ff)
+			if Layout == "filter-flat" {
+				ffpath = path.Join(DestinationBasePath, filterFolderName(ff))
+				flatNames = map[string]string{}
+			}
 			err := os.MkdirAll(ffpath, os.ModePerm)
 			if err != nil {
 				if !silentMode {
-					fmt.Println(errorColor("Error:"), err)
+					fmt.Fprintln(Output, errorColor("Error:"), err)
 				}
 				return err
 			}
-			newModelDatasetName := fmt.Sprintf("%s:%s", modelP, ff)
+			newModelDatasetName := fmt.Sprintf("%s:%s", modelP, strings.Join(append([]string{ff}, exclusions...), ","))
 			err = processHFFolderTree(ffpath, IsDataset, SkipSHA, newModelDatasetName, ModelBranch, "", silentMode) // passing empty as foldername, because its the first root folder
 			if err != nil {
 				if !silentMode {
-					fmt.Println(errorColor("Error:"), err)
+					fmt.Fprintln(Output, errorColor("Error:"), err)
 				}
 				return err
 			}
@@ -106,50 +330,90 @@ func DownloadModel(ModelDatasetName string, AppendFilterToPath bool, SkipSHA boo
 		err := os.MkdirAll(modelPath, os.ModePerm)
 		if err != nil {
 			if !silentMode {
-				fmt.Println(errorColor("Error:"), err)
+				fmt.Fprintln(Output, errorColor("Error:"), err)
 			}
 			return err
 		}
 		// ok we need to add some logic here now to analyze the model/dataset before we go into downloading
 
 		// get root path files and folders
-		err = processHFFolderTree(modelPath, IsDataset, SkipSHA, ModelDatasetName, ModelBranch, "", silentMode) // passing empty as foldername, because its the first root folder
+		// with Files, the walk starts at their deepest common folder, a single file only lists its own folder
+		err = processHFFolderTree(modelPath, IsDataset, SkipSHA, ModelDatasetName, ModelBranch, filesRoot(), silentMode)
 		if err != nil {
 			if !silentMode {
-				fmt.Println(errorColor("Error:"), err)
+				fmt.Fprintln(Output, errorColor("Error:"), err)
 			}
 			return err
 		}
 	}
 
+	if !silentMode {
+		fmt.Fprintf(Output, "\n%s", infoColor("Files: ", len(stats.downloaded), " downloaded, ", len(stats.upToDate), " up to date, ", stats.filtered, " filtered out"))
+		if len(stats.noSpace) > 0 {
+			fmt.Fprintf(Output, "\n%s", warningColor("Stopped when the disk got full, ", len(stats.noSpace), " files not downloaded:"))
+			for _, f := range stats.noSpace {
+				fmt.Fprintf(Output, "\n  %s", f)
+			}
+		}
+		if stats.scanRetries > 0 {
+			fmt.Fprintf(Output, "\n%s", warningColor("File list requests retried: ", stats.scanRetries))
+		}
+		if HasFilter {
+			total := len(stats.downloaded) + len(stats.upToDate) + stats.filtered + len(stats.noSpace)
+			fmt.Fprintf(Output, "\n%s", infoColor("Filter matched ", total-stats.filtered, " / ", total, " files"))
+		}
+	}
+	var missing []string
+	for _, f := range Files {
+		if !filesFound[strings.Trim(f, "/")] {
+			missing = append(missing, f)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("\n%s", errorColor("Files not found in the repo: ", strings.Join(missing, ", ")))
+	}
+	if len(stats.downloaded)+len(stats.upToDate)+len(stats.noSpace) == 0 && !AllowEmpty {
+		return ErrNoFiles
+	}
+	if WriteManifest {
+		return writeManifest(ManifestPath(DestinationBasePath, modelP), modelP, ModelBranch)
+	}
 	return nil
 }
 func processHFFolderTree(ModelPath string, IsDataset bool, SkipSHA bool, ModelDatasetName string, Branch string, folderName string, silentMode bool) error {
-	JsonTreeVariable := JsonModelsFileTreeURL // we assume its Model first
-	RawFileURL := RawModelFileURL
-	LfsResolverURL := LfsModelResolverURL
-	AgreementURL := fmt.Sprintf(AgreementModelURL, ModelDatasetName)
+	JsonTreeVariable := EndpointURL(JsonModelsFileTreeURL) // we assume its Model first
+	RawFileURL := EndpointURL(RawModelFileURL)
+	LfsResolverURL := EndpointURL(LfsModelResolverURL)
+	AgreementURL := fmt.Sprintf(EndpointURL(AgreementModelURL), ModelDatasetName)
 	HasFilter := false
 	var FilterBinFileString []string
 	originalDataSetName := ModelDatasetName // fix a bug where filters will be skipped when we call the function recursiley
 	if strings.Contains(ModelDatasetName, ":") && !IsDataset {
 		HasFilter = true
 		// remove the filtered content from Model Name
-		f := strings.Split(ModelDatasetName, ":")
-		ModelDatasetName = f[0]
-		FilterBinFileString = strings.Split(strings.ToLower(f[1]), ",")
+		var filters string
+		ModelDatasetName, filters, _ = strings.Cut(ModelDatasetName, ":")
+		FilterBinFileString = splitFilters(filters)
 		if !silentMode {
-			fmt.Printf("\n%s", infoColor("Filter Has been applied, will include LFS Model Files that contains: ", FilterBinFileString))
+			if StrictFilters {
+				fmt.Fprintf(Output, "\n%s", infoColor("Strict Filter Has been applied, will only include Files that contains: ", FilterBinFileString))
+			} else {
+				fmt.Fprintf(Output, "\n%s", infoColor("Filter Has been applied, will include LFS Model Files that contains: ", FilterBinFileString))
+			}
 		}
 	}
 	if IsDataset {
-		JsonTreeVariable = JsonDatasetFileTreeURL // set this to true if it its set to Dataset
-		RawFileURL = RawDatasetFileURL
-		LfsResolverURL = LfsDatasetResolverURL
-		AgreementURL = fmt.Sprintf(AgreementDatasetURL, ModelDatasetName)
+		JsonTreeVariable = EndpointURL(JsonDatasetFileTreeURL) // set this to true if it its set to Dataset
+		RawFileURL = EndpointURL(RawDatasetFileURL)
+		LfsResolverURL = EndpointURL(LfsDatasetResolverURL)
+		AgreementURL = fmt.Sprintf(EndpointURL(AgreementDatasetURL), ModelDatasetName)
 	}
 
 	tempFolder := path.Join(ModelPath, folderName, "tmp")
+	if Layout == "filter-flat" || Layout == "hub" {
+		// there are no sub folders, and a sub folder removing its tmp folder must not remove the parts of its parent
+		tempFolder = path.Join(ModelPath, "tmp", folderName)
+	}
 	// updated ver: 1.2.5; I cannot clear it if I'm trying to implement resume broken downloads based on a single file
 	// if _, err := os.Stat(tempFolder); err == nil { //clear it if it exists before for any reason
 	// 	err = os.RemoveAll(tempFolder)
@@ -160,7 +424,7 @@ func processHFFolderTree(ModelPath string, IsDataset bool, SkipSHA bool, ModelDa
 	err := os.MkdirAll(tempFolder, os.ModePerm)
 	if err != nil {
 		if !silentMode {
-			fmt.Println(errorColor("Error:", err))
+			fmt.Fprintln(Output, errorColor("Error:", err))
 		}
 		return err
 	}
@@ -186,19 +450,19 @@ func processHFFolderTree(ModelPath string, IsDataset bool, SkipSHA bool, ModelDa
 			if file.NeedsDownload {
 				if file.IsLFS || needsDownload(filePath, file.Size) {
 					tempFolder := filepath.Join(ModelPath, "tmp")
-					downloadErr := downloadFileMultiThread(tempFolder, file.DownloadLink, filePath, silentMode)
+					downloadErr := downloadFileMultiThread(tempFolder, file.DownloadLink, file.ResolverURL, filePath, silentMode)
 					if downloadErr != nil {
 						if !silentMode {
-							fmt.Printf("\n%s", errorColor("Error downloading file with multi-threading: ", downloadErr))
+							fmt.Fprintf(Output, "\n%s", errorColor("Error downloading file with multi-threading: ", downloadErr))
 						}
 						return downloadErr
 					}
 				} else {
 					// For smaller files or if not using multi-threading, a single-threaded download can be used
-					downloadErr := downloadSingleThreaded(file.DownloadLink, filePath)
+					downloadErr := downloadSingleThreaded(file.DownloadLink, filePath, int64(file.Size))
 					if downloadErr != nil {
 						if !silentMode {
-							fmt.Printf("\n%s", errorColor("Error downloading file with single-threading: ", downloadErr))
+							fmt.Fprintf(Output, "\n%s", errorColor("Error downloading file with single-threading: ", downloadErr))
 						}
 						return downloadErr
 					}
@@ -207,55 +471,35 @@ func processHFFolderTree(ModelPath string, IsDataset bool, SkipSHA bool, ModelDa
 		}
 	}
 	if !silentMode {
-		fmt.Printf("\n%s", infoColor("Getting File Download Files List Tree from: ", JsonFileListURL))
-	}
-
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", JsonFileListURL, nil)
-	if err != nil {
-		return err
-	}
-	if RequiresAuth {
-		// Set the authorization header with the Bearer token
-		bearerToken := AuthToken
-		req.Header.Add("Authorization", "Bearer "+bearerToken)
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		if !silentMode {
-			fmt.Println(errorColor("Error:"), err)
-		}
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == 401 && !RequiresAuth {
-		return fmt.Errorf("\n%s", errorColor("Repo requires access token, generate an access token form huggingface, and pass it using flag: -t TOKEN"))
-	}
-	if resp.StatusCode == 403 {
-		return fmt.Errorf("\n%s", errorColor("You need to manually accept the agreement for this model/dataset: ", AgreementURL, " on HuggingFace site, No bypass will be implemented"))
-	}
-	// Read the response body into a byte slice
-	content, err := io.ReadAll(resp.Body)
-	if err != nil {
-		if !silentMode {
-			fmt.Println(errorColor("Error:"), err)
-		}
-		return err
-
+		fmt.Fprintf(Output, "\n%s", infoColor("Getting File Download Files List Tree from: ", JsonFileListURL))
 	}
 
-	err = json.Unmarshal(content, &jsonFilesList)
+	jsonFilesList, err = fetchFileList(JsonFileListURL, AgreementURL, silentMode)
 	if err != nil {
 		return err
 	}
 	for i := range jsonFilesList {
 		jsonFilesList[i].AppendedPath = path.Join(ModelPath, jsonFilesList[i].Path)
+		if err := checkNameLengths(jsonFilesList[i].AppendedPath); err != nil {
+			return err
+		}
 		if jsonFilesList[i].Type == "directory" {
 			jsonFilesList[i].IsDirectory = true
-			err := os.MkdirAll(path.Join(ModelPath, jsonFilesList[i].Path), os.ModePerm)
-			if err != nil {
-				return err
+			// root files are at depth 0, so the files of folder "a/b" are at depth 2
+			if (len(Files) > 0 || len(Includes) > 0) && !wantedFolder(jsonFilesList[i].Path) {
+				continue // no requested file in there, no need to walk it
+			}
+			if MaxDepth > 0 && strings.Count(jsonFilesList[i].Path, "/")+1 > MaxDepth {
+				if !silentMode {
+					fmt.Fprintf(Output, "\n%s", infoColor("Skipping folder deeper than max depth: ", jsonFilesList[i].Path))
+				}
+				continue
+			}
+			if Layout == "" {
+				err := os.MkdirAll(path.Join(ModelPath, jsonFilesList[i].Path), os.ModePerm)
+				if err != nil {
+					return err
+				}
 			}
 			jsonFilesList[i].SkipDownloading = true
 			// now if this a folder, this whole function will be called again recursively
@@ -267,34 +511,38 @@ func processHFFolderTree(ModelPath string, IsDataset bool, SkipSHA bool, ModelDa
 			}
 			continue
 		}
+		if Layout == "filter-flat" {
+			jsonFilesList[i].AppendedPath = flatPath(ModelPath, jsonFilesList[i].Path)
+		}
 
 		jsonFilesList[i].DownloadLink = fmt.Sprintf(RawFileURL, ModelDatasetName, branch, jsonFilesList[i].Path)
-		if jsonFilesList[i].Lfs != nil {
-			jsonFilesList[i].IsLFS = true
+		jsonFilesList[i].IsLFS = jsonFilesList[i].Lfs != nil
+		if Layout == "hub" {
+			jsonFilesList[i].AppendedPath = hubBlobPath(ModelPath, jsonFilesList[i])
+		}
+		// Check for filter, LFS files are only kept when they match a filter, and so are all other files with StrictFilters
+		if HasFilter && (jsonFilesList[i].IsLFS || StrictFilters) {
+			jsonFilesList[i].FilterSkip = !matchesFilter(jsonFilesList[i].Path, FilterBinFileString)
+		}
+		jsonFilesList[i].FilterSkip = allowlistSkip(jsonFilesList[i].Path, jsonFilesList[i].FilterSkip)
+	}
+	if HasFilter && len(Files) == 0 {
+		groupSplitSets(jsonFilesList, silentMode)
+	}
+	for i := range jsonFilesList {
+		if jsonFilesList[i].Type != "directory" && excluded(jsonFilesList[i].Path) {
+			jsonFilesList[i].FilterSkip = true // after groupSplitSets, an excluded member stays out of its set
+		}
+	}
+	for i := range jsonFilesList {
+		if jsonFilesList[i].IsLFS && !jsonFilesList[i].FilterSkip {
 			resolverURL := fmt.Sprintf(LfsResolverURL, ModelDatasetName, branch, jsonFilesList[i].Path)
 			getLink, err := getRedirectLink(resolverURL)
 			if err != nil {
 				return err
 			}
-			// Check for filter
-			if HasFilter {
-				filenameLowerCase := strings.ToLower(jsonFilesList[i].Path)
-				if strings.HasSuffix(filenameLowerCase, ".act") || strings.HasSuffix(filenameLowerCase, ".bin") ||
-					strings.Contains(filenameLowerCase, ".gguf") || // either *.gguf or *.gguf-split-{a, b, ...}
-					strings.HasSuffix(filenameLowerCase, ".safetensors") || strings.HasSuffix(filenameLowerCase, ".pt") || strings.HasSuffix(filenameLowerCase, ".meta") ||
-					strings.HasSuffix(filenameLowerCase, ".zip") || strings.HasSuffix(filenameLowerCase, ".z01") || strings.HasSuffix(filenameLowerCase, ".onnx") || strings.HasSuffix(filenameLowerCase, ".data") ||
-					strings.HasSuffix(filenameLowerCase, ".onnx_data") ||
-					strings.HasSuffix(filenameLowerCase, ".llamafile") {
-					jsonFilesList[i].FilterSkip = true // we assume its skipped, unless below condition range match
-					for _, ff := range FilterBinFileString {
-						if strings.Contains(filenameLowerCase, ff) {
-							jsonFilesList[i].FilterSkip = false
-						}
-					}
-
-				}
-			}
 			jsonFilesList[i].DownloadLink = getLink
+			jsonFilesList[i].ResolverURL = resolverURL
 		}
 	}
 	// UNCOMMENT BELOW TWO LINES TO DEBUG THIS FOLDER JSON STRUCTURE
@@ -310,19 +558,46 @@ func processHFFolderTree(ModelPath string, IsDataset bool, SkipSHA bool, ModelDa
 		if jsonFilesList[i].FilterSkip {
 			continue
 		}
+		if dst := routeDestination(jsonFilesList[i].Path); dst != "" {
+			if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+				return err
+			}
+			jsonFilesList[i].AppendedPath = dst
+		}
+		if FileHook != nil {
+			skip, newDst, err := FileHook(RepoFile{
+				Path:        jsonFilesList[i].Path,
+				Size:        int64(jsonFilesList[i].Size),
+				IsLFS:       jsonFilesList[i].IsLFS,
+				Destination: jsonFilesList[i].AppendedPath,
+			})
+			if err != nil {
+				return err
+			}
+			if skip {
+				jsonFilesList[i].FilterSkip = true // a veto from the hook is reported like a filter
+				continue
+			}
+			if newDst != "" {
+				if err := os.MkdirAll(filepath.Dir(newDst), os.ModePerm); err != nil {
+					return err
+				}
+				jsonFilesList[i].AppendedPath = newDst
+			}
+		}
 		filename := jsonFilesList[i].AppendedPath
 		if _, err := os.Stat(filename); err == nil {
 			// File exists, get its size
 			fileInfo, _ := os.Stat(filename)
 			size := fileInfo.Size()
 			if !silentMode {
-				fmt.Printf("\n%s", infoColor("Checking Existing file: ", jsonFilesList[i].AppendedPath))
+				fmt.Fprintf(Output, "\n%s", infoColor("Checking Existing file: ", jsonFilesList[i].AppendedPath))
 			}
 			//  for non-lfs files, I can only compare size, I don't there is a sha256 hash for them
 			if size == int64(jsonFilesList[i].Size) {
 				jsonFilesList[i].SkipDownloading = true
 				if jsonFilesList[i].IsLFS {
-					if !SkipSHA {
+					if existingVerifyMode(jsonFilesList[i], SkipSHA) == "sha256" {
 						err := verifyChecksum(jsonFilesList[i].AppendedPath, jsonFilesList[i].Lfs.Oid_SHA265)
 						if err != nil {
 							err := os.Remove(jsonFilesList[i].AppendedPath)
@@ -331,22 +606,46 @@ func processHFFolderTree(ModelPath string, IsDataset bool, SkipSHA bool, ModelDa
 							}
 							jsonFilesList[i].SkipDownloading = false
 							if !silentMode {
-								fmt.Printf("\n%s", warningColor("Hash failed for LFS file: ", jsonFilesList[i].AppendedPath, ", will redownload/resume"))
+								fmt.Fprintf(Output, "\n%s", warningColor("Hash failed for LFS file: ", jsonFilesList[i].AppendedPath, ", will redownload"))
 							}
-							return err
-						}
-						if !silentMode {
-							fmt.Printf("\n%s", successColor("Hash Matched for LFS file: ", jsonFilesList[i].AppendedPath))
+						} else if !silentMode {
+							fmt.Fprintf(Output, "\n%s", successColor("Hash Matched for LFS file: ", jsonFilesList[i].AppendedPath))
 						}
 					} else {
 						if !silentMode {
-							fmt.Printf("\n%s", infoColor("Hash Matching SKIPPED for LFS file: ", jsonFilesList[i].AppendedPath))
+							fmt.Fprintf(Output, "\n%s", infoColor("Hash Matching SKIPPED for LFS file: ", jsonFilesList[i].AppendedPath))
 						}
 					}
 
 				} else {
 					if !silentMode {
-						fmt.Printf("\n%s", successColor("file size matched for non LFS file: ", jsonFilesList[i].AppendedPath))
+						fmt.Fprintf(Output, "\n%s", successColor("file size matched for non LFS file: ", jsonFilesList[i].AppendedPath))
+					}
+					if existingVerifyMode(jsonFilesList[i], SkipSHA) == "sha256" {
+						// non-lfs files have no sha256, the git blob oid is the only hash we can check against
+						if err := verifyGitOid(jsonFilesList[i].AppendedPath, jsonFilesList[i].Oid); err != nil {
+							jsonFilesList[i].SkipDownloading = false
+							if !silentMode {
+								fmt.Fprintf(Output, "\n%s", warningColor("Hash failed for non LFS file: ", jsonFilesList[i].AppendedPath, ", will redownload"))
+							}
+						} else if !silentMode {
+							fmt.Fprintf(Output, "\n%s", successColor("Hash Matched for non LFS file: ", jsonFilesList[i].AppendedPath))
+						}
+					}
+				}
+			} else {
+				switch OnExistingDifferentSize {
+				case "skip":
+					jsonFilesList[i].SkipDownloading = true
+					if !silentMode {
+						fmt.Fprintf(Output, "\n%s", warningColor("File size mismatch, keeping existing file as is: ", jsonFilesList[i].AppendedPath))
+					}
+				case "error":
+					return fmt.Errorf("\n%s", errorColor("Existing file size mismatch: ", jsonFilesList[i].AppendedPath, ", filesize: ", size, " Needed Size: ", jsonFilesList[i].Size))
+				case "resume":
+					// only a local file smaller than the remote one can be a prefix of it, anything else is downloaded again
+					if size < int64(jsonFilesList[i].Size) {
+						jsonFilesList[i].LocalSize = size
 					}
 				}
 			}
@@ -360,59 +659,122 @@ func processHFFolderTree(ModelPath string, IsDataset bool, SkipSHA bool, ModelDa
 			continue
 		}
 		if jsonFilesList[i].SkipDownloading {
+			stats.upToDate = append(stats.upToDate, localPath(jsonFilesList[i]))
+			skipFileStat(jsonFilesList[i], "up to date")
+			if err := linkSnapshot(jsonFilesList[i]); err != nil {
+				return err
+			}
+			// OnExistingDifferentSize "skip" keeps files of another size, they are not part of the manifest
+			if fi, err := os.Stat(jsonFilesList[i].AppendedPath); err == nil && fi.Size() == int64(jsonFilesList[i].Size) {
+				if err := addManifestEntry(jsonFilesList[i], existingVerifyMode(jsonFilesList[i], SkipSHA) == "sha256"); err != nil {
+					return err
+				}
+			}
 			if !silentMode {
-				fmt.Printf("\n%s", infoColor("Skipping: ", jsonFilesList[i].AppendedPath))
+				fmt.Fprintf(Output, "\n%s", infoColor("Skipping (up to date): ", jsonFilesList[i].AppendedPath))
 			}
 			continue
 		}
 		if jsonFilesList[i].FilterSkip {
+			stats.filtered++
+			skipFileStat(jsonFilesList[i], "filtered")
 			if !silentMode {
-				fmt.Printf("\n%s", infoColor("Filter Skipping: ", jsonFilesList[i].AppendedPath))
+				fmt.Fprintf(Output, "\n%s", infoColor("Skipping (filtered): ", jsonFilesList[i].AppendedPath))
 			}
 			continue
 		}
+		if StopWhenFull {
+			// once a file did not fit the job is over, later smaller files are not squeezed in
+			fits := len(stats.noSpace) == 0
+			if fits {
+				var err error
+				if fits, err = fitsOnDisk(jsonFilesList[i]); err != nil {
+					return err
+				}
+			}
+			if !fits {
+				stats.noSpace = append(stats.noSpace, jsonFilesList[i].AppendedPath)
+				skipFileStat(jsonFilesList[i], "disk full")
+				if !silentMode {
+					fmt.Fprintf(Output, "\n%s", warningColor("Skipping (disk full): ", jsonFilesList[i].AppendedPath))
+				}
+				continue
+			}
+		}
+		stats.downloaded = append(stats.downloaded, localPath(jsonFilesList[i]))
+		started := startFileStat(jsonFilesList[i])
+		if err := waitForDiskSpace(path.Dir(jsonFilesList[i].AppendedPath), silentMode); err != nil {
+			return err
+		}
 		// fmt.Printf("Downloading: %s\n", jsonFilesList[i].Path)
 		if jsonFilesList[i].IsLFS {
-			err := downloadFileMultiThread(tempFolder, jsonFilesList[i].DownloadLink, jsonFilesList[i].AppendedPath, silentMode)
+			var err error
+			if jsonFilesList[i].LocalSize > 0 {
+				err = resumeSingleThreaded(jsonFilesList[i].DownloadLink, jsonFilesList[i].AppendedPath, jsonFilesList[i].LocalSize, int64(jsonFilesList[i].Size))
+				if errors.Is(err, errLinkExpired) && jsonFilesList[i].ResolverURL != "" {
+					var freshLink string
+					if freshLink, err = getRedirectLink(jsonFilesList[i].ResolverURL); err == nil {
+						if !silentMode {
+							fmt.Fprintf(Output, "\n%s", warningColor("Download link expired, retrying with a fresh one: ", jsonFilesList[i].AppendedPath))
+						}
+						jsonFilesList[i].DownloadLink = freshLink
+						trackTransfer(jsonFilesList[i].AppendedPath, func(t *transfer) { t.refreshes++ })
+						err = resumeSingleThreaded(freshLink, jsonFilesList[i].AppendedPath, jsonFilesList[i].LocalSize, int64(jsonFilesList[i].Size))
+					}
+				}
+			} else {
+				err = downloadFileMultiThread(tempFolder, jsonFilesList[i].DownloadLink, jsonFilesList[i].ResolverURL, jsonFilesList[i].AppendedPath, silentMode)
+			}
 			if err != nil {
 				return err
 			}
 			// lfs file, verify by checksum
-			if !silentMode {
-				fmt.Printf("\n%s", infoColor("Checking SHA256 Hash for LFS file: ", jsonFilesList[i].AppendedPath))
-			}
-			if !SkipSHA {
+			if verifyMode(jsonFilesList[i], SkipSHA) == "sha256" {
+				// hashing a big file takes a while once the download reached 100%, so say so, and how long it took
+				if !silentMode {
+					fmt.Fprintf(Output, "\n%s", infoColor("Checking SHA256 Hash for LFS file: ", jsonFilesList[i].AppendedPath, fmt.Sprintf(" (%.2f MB), this can take a while", float64(jsonFilesList[i].Size)/(1024*1024))))
+				}
+				hashStart := time.Now()
 				err = verifyChecksum(jsonFilesList[i].AppendedPath, jsonFilesList[i].Lfs.Oid_SHA265)
 				if err != nil {
-					err := os.Remove(jsonFilesList[i].AppendedPath)
-					if err != nil {
+					if err := os.Remove(jsonFilesList[i].AppendedPath); err != nil {
 						return err
 					}
-					// jsonFilesList[i].SkipDownloading = false
-					if !silentMode {
-						fmt.Printf("\n%s", errorColor("Hash failed for LFS file: ", jsonFilesList[i].AppendedPath, "will redownload/resume"))
-					}
-					return err
+					// the checksum error, not the nil of the remove, so the run fails and a retry downloads the file again
+					return fmt.Errorf("\n%s", errorColor("Hash failed for LFS file: ", jsonFilesList[i].AppendedPath, ", ", err))
 				}
 				if !silentMode {
-					fmt.Printf("\n%s", successColor("Hash Matched for LFS file: ", jsonFilesList[i].AppendedPath))
+					fmt.Fprintf(Output, "\n%s", successColor("Hash Matched for LFS file: ", jsonFilesList[i].AppendedPath, ", in ", time.Since(hashStart).Round(100*time.Millisecond)))
 				}
 
 			} else {
 				if !silentMode {
-					fmt.Printf("\n%s", warningColor("Hash Matching SKIPPED for LFS file: ", jsonFilesList[i].AppendedPath))
+					fmt.Fprintf(Output, "\n%s", warningColor("Hash Matching SKIPPED for LFS file: ", jsonFilesList[i].AppendedPath))
+				}
+				// without a hash, the size is the only check left against a truncated file
+				if fi, err := os.Stat(jsonFilesList[i].AppendedPath); err != nil {
+					return err
+				} else if fi.Size() != int64(jsonFilesList[i].Size) {
+					return fmt.Errorf("\n%s", errorColor("File size mismatch: ", jsonFilesList[i].AppendedPath, ", filesize: ", fi.Size(), " Needed Size: ", jsonFilesList[i].Size))
 				}
 			}
 
 		} else {
 			// err := downloadFileMultiThread(tempFolder, jsonFilesList[i].DownloadLink, jsonFilesList[i].AppendedPath) //maybe later I'll enable multithreading for all files, even non-lfs
-			err = downloadSingleThreaded(jsonFilesList[i].DownloadLink, jsonFilesList[i].AppendedPath) // no checksum available for small non-lfs files
+			if jsonFilesList[i].LocalSize > 0 {
+				err = resumeSingleThreaded(jsonFilesList[i].DownloadLink, jsonFilesList[i].AppendedPath, jsonFilesList[i].LocalSize, int64(jsonFilesList[i].Size))
+			} else if ProbeRanges && int64(jsonFilesList[i].Size) >= ProbeRangesMinSize {
+				// the size probe falls back to a single connection when the server has no range support
+				err = downloadFileMultiThread(tempFolder, jsonFilesList[i].DownloadLink, "", jsonFilesList[i].AppendedPath, silentMode)
+			} else {
+				err = downloadSingleThreaded(jsonFilesList[i].DownloadLink, jsonFilesList[i].AppendedPath, int64(jsonFilesList[i].Size)) // no checksum available for small non-lfs files
+			}
 			if err != nil {
 				return err
 			}
 			// non-lfs file, verify by size matching
 			if !silentMode {
-				fmt.Printf("\nChecking file size matching: %s", jsonFilesList[i].AppendedPath)
+				fmt.Fprintf(Output, "\nChecking file size matching: %s", jsonFilesList[i].AppendedPath)
 			}
 			if _, err := os.Stat(jsonFilesList[i].AppendedPath); err == nil {
 				fileInfo, _ := os.Stat(jsonFilesList[i].AppendedPath)
@@ -423,70 +785,392 @@ func processHFFolderTree(ModelPath string, IsDataset bool, SkipSHA bool, ModelDa
 			} else {
 				return fmt.Errorf("\n%s", errorColor("File does not exist: ", jsonFilesList[i].AppendedPath))
 			}
+			if verifyMode(jsonFilesList[i], SkipSHA) == "sha256" {
+				if err := verifyGitOid(jsonFilesList[i].AppendedPath, jsonFilesList[i].Oid); err != nil {
+					return err
+				}
+				if !silentMode {
+					fmt.Fprintf(Output, "\n%s", successColor("Hash Matched for non LFS file: ", jsonFilesList[i].AppendedPath))
+				}
+			}
+		}
+		// the etag mode checks the remote file did not change since the data was received, against the ETag of the responses it came from
+		if verifyMode(jsonFilesList[i], SkipSHA) == "etag" {
+			jsonFilesList[i].ETag = normalizeETag(transferFor(jsonFilesList[i].AppendedPath).etag)
+			if jsonFilesList[i].ETag == "" {
+				os.Remove(jsonFilesList[i].AppendedPath)
+				return fmt.Errorf("\n%s", errorColor("No ETag received for ", jsonFilesList[i].Path, ", it can't be verified with the etag mode"))
+			}
+			etagAfter, err := remoteETag(jsonFilesList[i])
+			if err != nil {
+				return err
+			}
+			if etagAfter != jsonFilesList[i].ETag {
+				os.Remove(jsonFilesList[i].AppendedPath)
+				return fmt.Errorf("\n%s", errorColor("ETag changed during the download of ", jsonFilesList[i].AppendedPath, ": ", jsonFilesList[i].ETag, " then ", etagAfter))
+			}
+			if !silentMode {
+				fmt.Fprintf(Output, "\n%s", successColor("ETag Matched for file: ", jsonFilesList[i].AppendedPath))
+			}
+		}
+		if err := addManifestEntry(jsonFilesList[i], verifyMode(jsonFilesList[i], SkipSHA) == "sha256"); err != nil {
+			return err
+		}
+		if err := linkSnapshot(jsonFilesList[i]); err != nil {
+			return err
+		}
+		finishFileStat(jsonFilesList[i], started)
+	}
+	if Prune || PruneDryRun {
+		err = pruneFolder(path.Join(ModelPath, folderName), jsonFilesList, silentMode)
+		if err != nil {
+			return err
 		}
 	}
 	os.RemoveAll(tempFolder) // by here its safe to delete the temp folder
 	return nil
 }
 
-func fetchFileList(JsonFileListURL string) ([]hfmodel, error) {
-	var filesList []hfmodel
-
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", JsonFileListURL, nil)
+// pruneFolder deletes local files and folders that are no longer listed in the repo tree of this folder
+func pruneFolder(folderPath string, jsonFilesList []hfmodel, silentMode bool) error {
+	inRepo := make(map[string]bool, len(jsonFilesList))
+	for _, file := range jsonFilesList {
+		inRepo[path.Base(file.Path)] = true
+	}
+	entries, err := os.ReadDir(folderPath)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if RequiresAuth {
-		req.Header.Add("Authorization", "Bearer "+AuthToken)
+	for _, entry := range entries {
+		if inRepo[entry.Name()] || (entry.IsDir() && entry.Name() == "tmp") || entry.Name() == ManifestFileName { // never touch our own files
+			continue
+		}
+		stalePath := path.Join(folderPath, entry.Name())
+		if PruneDryRun {
+			if !silentMode {
+				fmt.Fprintf(Output, "\n%s", warningColor("Would prune (not in repo anymore): ", stalePath))
+			}
+			continue
+		}
+		if !silentMode {
+			fmt.Fprintf(Output, "\n%s", warningColor("Pruning (not in repo anymore): ", stalePath))
+		}
+		if err := os.RemoveAll(stalePath); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+// ErrNoFiles is returned when the repo, branch and filters select no file at all, which is most likely a typo rather than a success
+var ErrNoFiles = errors.New("no files to download, check the repo name, branch and filters, or allow it with --allowEmpty")
 
-	if err := json.NewDecoder(resp.Body).Decode(&filesList); err != nil {
-		return nil, err
-	}
+// ErrTooManyRetries is returned once more than MaxTotalRetries retries happened, incomplete downloads are kept to be resumed
+var ErrTooManyRetries = errors.New("connection too unstable, too many retries in total, incomplete downloads are kept to be resumed")
 
-	return filesList, nil
+// AddRetry counts a retry towards MaxTotalRetries, returning ErrTooManyRetries once it is exceeded
+func AddRetry() error {
+	n := atomic.AddInt64(&totalRetries, 1)
+	if MaxTotalRetries > 0 && n > int64(MaxTotalRetries) {
+		return ErrTooManyRetries
+	}
+	return nil
 }
 
-func needsDownload(filePath string, remoteSize int) bool {
-	info, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		return true
+// fetchFileList gets the tree of a folder, transient failures (network error, 5xx, response cut off mid-JSON) are retried up to ScanRetries times
+func fetchFileList(JsonFileListURL string, AgreementURL string, silentMode bool) ([]hfmodel, error) {
+	treeMu.Lock()
+	cached, ok := treeCache[JsonFileListURL]
+	treeMu.Unlock()
+	if ok {
+		return append([]hfmodel(nil), cached...), nil // a copy, each filter folder run of -f updates the entries
 	}
-	return info.Size() != int64(remoteSize)
+	// big folders are split in pages, the next one is given by the Link header
+	var filesList []hfmodel
+	for pageURL := JsonFileListURL; pageURL != ""; {
+		page, next, err := fetchFileListPage(pageURL, AgreementURL, silentMode)
+		if err != nil {
+			return nil, err
+		}
+		filesList = append(filesList, page...)
+		pageURL = next
+	}
+	return filesList, nil
 }
 
-// ***********************************************   All the functions below generated by ChatGPT 3.5, and ChatGPT 4 , with some modifications ***********************************************
-func IsValidModelName(modelName string) bool {
-	pattern := `^[A-Za-z0-9_\-]+/[A-Za-z0-9\._\-]+$`
-	match, _ := regexp.MatchString(pattern, modelName)
-	return match
+// fetchFileListPage gets one page of a folder listing, retrying it ScanRetries times, and returns the URL of the next page, if any
+func fetchFileListPage(JsonFileListURL string, AgreementURL string, silentMode bool) ([]hfmodel, string, error) {
+	retries := ScanRetries
+	if retries < 1 {
+		retries = 1 // the request is always made once
+	}
+	var err error
+	for attempt := 1; attempt <= retries; attempt++ {
+		var filesList []hfmodel
+		var next string
+		var retryable bool
+		filesList, next, retryable, err = fetchFileListOnce(JsonFileListURL, AgreementURL)
+		if err == nil {
+			return filesList, next, nil
+		}
+		if !retryable || attempt == retries {
+			break
+		}
+		delay := time.Duration(attempt) * time.Second
+		if requested := RetryDelay(err); requested > delay {
+			delay = requested
+			if !silentMode {
+				fmt.Fprintf(Output, "\n%s", warningColor("Server asked to wait ", delay.Round(time.Second), " before retrying"))
+			}
+		}
+		if !silentMode {
+			fmt.Fprintf(Output, "\n%s", warningColor("File list request failed, retrying (", attempt, "/", retries, "): ", JsonFileListURL, ": ", err))
+		}
+		treeMu.Lock() // folders can be listed concurrently, see prefetchTree
+		stats.scanRetries++
+		treeMu.Unlock()
+		if err := AddRetry(); err != nil {
+			return nil, "", err
+		}
+		time.Sleep(delay)
+	}
+	if !silentMode {
+		fmt.Fprintln(Output, errorColor("Error:"), err)
+	}
+	return nil, "", err
 }
 
-func getRedirectLink(url string) (string, error) {
-
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			if RequiresAuth {
-				bearerToken := AuthToken
-				req.Header.Add("Authorization", "Bearer "+bearerToken)
-			}
-			return http.ErrUseLastResponse
-		},
+// prefetchTree lists the folders of the repo up front, ScanConcurrency at a time, so processHFFolderTree finds them in treeCache
+// instead of listing them one after the other, which is slow for repos with many folders
+func prefetchTree(JsonTreeVariable string, ModelDatasetName string, Branch string, AgreementURL string, root string, silentMode bool) error {
+	workers := ScanConcurrency
+	if workers <= 0 {
+		workers = NumConnections
 	}
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return "", err
+	treeMu.Lock()
+	treeCache = map[string][]hfmodel{}
+	treeMu.Unlock()
+	if workers <= 1 {
+		return nil
 	}
-	if RequiresAuth {
-		// Set the authorization header with the Bearer token
-		bearerToken := AuthToken
+	connections := make(chan struct{}, workers)
+	wg := &sync.WaitGroup{}
+	var firstErr error
+	var list func(folderName string)
+	list = func(folderName string) {
+		defer wg.Done()
+		treeMu.Lock()
+		failed := firstErr != nil
+		treeMu.Unlock()
+		if failed {
+			return
+		}
+		JsonFileListURL := fmt.Sprintf(JsonTreeVariable, ModelDatasetName, Branch, folderName)
+		connections <- struct{}{}
+		files, err := fetchFileList(JsonFileListURL, AgreementURL, silentMode)
+		<-connections
+		treeMu.Lock()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		} else if err == nil {
+			treeCache[JsonFileListURL] = files
+		}
+		treeMu.Unlock()
+		for _, file := range files {
+			// the same folders processHFFolderTree walks into
+			if file.Type != "directory" || ((len(Files) > 0 || len(Includes) > 0) && !wantedFolder(file.Path)) {
+				continue
+			}
+			if MaxDepth > 0 && strings.Count(file.Path, "/")+1 > MaxDepth {
+				continue
+			}
+			wg.Add(1)
+			go list(file.Path)
+		}
+	}
+	wg.Add(1)
+	list(root)
+	wg.Wait()
+	return firstErr
+}
+
+// fetchFileListOnce does a single tree request, retryable reports whether the failure is transient, unlike auth errors or malformed JSON
+func fetchFileListOnce(JsonFileListURL string, AgreementURL string) (filesList []hfmodel, next string, retryable bool, err error) {
+	client, err := NewHTTPClient()
+	if err != nil {
+		return nil, "", false, err
+	}
+	req, err := http.NewRequest("GET", JsonFileListURL, nil)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if RequiresAuth {
+		req.Header.Add("Authorization", "Bearer "+AuthToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, "", true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return nil, "", true, statusError(resp)
+	}
+	if resp.StatusCode == 401 && !RequiresAuth {
+		return nil, "", false, fmt.Errorf("\n%s", errorColor("Repo requires access token, generate an access token form huggingface, and pass it using flag: -t TOKEN"))
+	}
+	if resp.StatusCode == 403 {
+		return nil, "", false, fmt.Errorf("\n%s", errorColor("You need to manually accept the agreement for this model/dataset: ", AgreementURL, " on HuggingFace site, No bypass will be implemented"))
+	}
+	// Read the response body into a byte slice
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", errors.Is(err, io.ErrUnexpectedEOF), err
+	}
+
+	// the decoder tells a body cut off mid-JSON, or empty, from malformed JSON, a syntax error that would come back the same
+	if err := json.NewDecoder(bytes.NewReader(content)).Decode(&filesList); err != nil {
+		return nil, "", errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF), err
+	}
+
+	return filesList, nextLink(resp), false, nil
+}
+
+// nextLink returns the URL of the rel="next" entry of the Link header, resolved against the request URL, or "" on the last page
+func nextLink(resp *http.Response) string {
+	for _, link := range strings.Split(resp.Header.Get("Link"), ",") {
+		target, params, ok := strings.Cut(link, ";")
+		if !ok || !strings.Contains(strings.NewReplacer(" ", "", `"`, "").Replace(params), "rel=next") {
+			continue
+		}
+		target = strings.Trim(strings.TrimSpace(target), "<>")
+		next, err := resp.Request.URL.Parse(target)
+		if err != nil {
+			return ""
+		}
+		return next.String()
+	}
+	return ""
+}
+
+// DetectDataset checks the model tree first and, if it is not found, the dataset tree, reporting whether the repo is a dataset
+func DetectDataset(ModelDatasetName string, Branch string, token string) (bool, error) {
+	modelP := strings.Split(ModelDatasetName, ":")[0] // filters are not part of the repo name
+	if token != "" {
+		RequiresAuth = true
+		AuthToken = token
+	}
+	modelStatus, err := treeStatus(JsonModelsFileTreeURL, modelP, Branch)
+	if err != nil {
+		return false, err
+	}
+	if modelStatus == 200 {
+		return false, nil
+	}
+	// huggingface answers 401 instead of 404 for unknown repos when no token is passed, so both mean "try the dataset tree"
+	datasetStatus, err := treeStatus(JsonDatasetFileTreeURL, modelP, Branch)
+	if err != nil {
+		return false, err
+	}
+	if datasetStatus == 200 {
+		return true, nil
+	}
+	if modelStatus == 404 && datasetStatus == 404 {
+		return false, fmt.Errorf("%s", errorColor("Repo not found as a model or a dataset: ", modelP))
+	}
+	// let the download itself report auth and agreement errors
+	return false, nil
+}
+
+func treeStatus(JsonTreeVariable string, ModelDatasetName string, Branch string) (int, error) {
+	client, err := NewHTTPClient()
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf(EndpointURL(JsonTreeVariable), ModelDatasetName, Branch, ""), nil)
+	if err != nil {
+		return 0, err
+	}
+	if RequiresAuth {
+		req.Header.Add("Authorization", "Bearer "+AuthToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// ErrInvalidToken is returned by WhoAmI when the server rejects the token with a 401, other failures say nothing about the token
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+// WhoAmI returns the username the token belongs to, an invalid or expired token is reported as ErrInvalidToken
+func WhoAmI(token string) (string, error) {
+	client, err := NewHTTPClient()
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("GET", EndpointURL(WhoAmIURL), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 401 {
+		return "", ErrInvalidToken
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("unexpected status from whoami: %s", resp.Status)
+	}
+	var whoami struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&whoami); err != nil {
+		return "", err
+	}
+	return whoami.Name, nil
+}
+
+func needsDownload(filePath string, remoteSize int) bool {
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return true
+	}
+	return info.Size() != int64(remoteSize)
+}
+
+// ***********************************************   All the functions below generated by ChatGPT 3.5, and ChatGPT 4 , with some modifications ***********************************************
+func IsValidModelName(modelName string) bool {
+	pattern := `^[A-Za-z0-9_\-]+/[A-Za-z0-9\._\-]+$`
+	match, _ := regexp.MatchString(pattern, modelName)
+	return match
+}
+
+func getRedirectLink(url string) (string, error) {
+
+	client, err := NewHTTPClient()
+	if err != nil {
+		return "", err
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if RequiresAuth {
+			bearerToken := AuthToken
+			req.Header.Add("Authorization", "Bearer "+bearerToken)
+		}
+		return http.ErrUseLastResponse
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	if RequiresAuth {
+		// Set the authorization header with the Bearer token
+		bearerToken := AuthToken
 		req.Header.Add("Authorization", "Bearer "+bearerToken)
 	}
 	resp, err := client.Do(req)
@@ -506,48 +1190,550 @@ func getRedirectLink(url string) (string, error) {
 	return "", fmt.Errorf(errorColor("No redirect found"))
 }
 
+// streamedHashes holds the sha256 of the files written in one pass this run, computed while writing them,
+// so verifyChecksum does not read huge files a second time
+var (
+	streamedMu     sync.Mutex
+	streamedHashes = map[string]string{}
+)
+
+// rememberStreamedHash records the hash of a file just written from start to end, an empty sum forgets it, as when the file is written in another way
+func rememberStreamedHash(filePath, sum string) {
+	streamedMu.Lock()
+	defer streamedMu.Unlock()
+	if sum == "" {
+		delete(streamedHashes, filePath)
+		return
+	}
+	streamedHashes[filePath] = sum
+}
+
+// takeStreamedHash returns and forgets the hash recorded for the file, it is only good for the check right after the download
+func takeStreamedHash(filePath string) (string, bool) {
+	streamedMu.Lock()
+	defer streamedMu.Unlock()
+	sum, ok := streamedHashes[filePath]
+	delete(streamedHashes, filePath)
+	return sum, ok
+}
+
 func verifyChecksum(filePath, expectedChecksum string) error {
+	actualChecksum, ok := takeStreamedHash(filePath)
+	if !ok {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, file); err != nil {
+			return err
+		}
+		actualChecksum = hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	if actualChecksum != expectedChecksum {
+		return fmt.Errorf("\n%s", errorColor("checksum mismatch: expected ", expectedChecksum, "got ", actualChecksum))
+	}
+
+	return nil
+}
+
+// waitForDiskSpace holds off the next file while free space is below MinFreeBytes, giving up after LowDiskGracePeriod
+func waitForDiskSpace(folder string, silentMode bool) error {
+	if MinFreeBytes == 0 {
+		return nil
+	}
+	deadline := time.Now().Add(LowDiskGracePeriod)
+	for {
+		free, err := FreeDiskSpace(folder)
+		if err != nil {
+			return err
+		}
+		if free >= MinFreeBytes {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("\n%s", errorColor("Low disk space: ", free/(1024*1024), " MB free on ", folder, ", below the minimum of ", MinFreeBytes/(1024*1024), " MB, incomplete downloads are kept to be resumed"))
+		}
+		if !silentMode {
+			fmt.Fprintf(Output, "\n%s", warningColor("Low disk space: ", free/(1024*1024), " MB free, below the minimum of ", MinFreeBytes/(1024*1024), " MB, waiting for space to be freed"))
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// splitSetPatterns recognize the split file naming schemes, the first group is the name shared by the whole set
+var splitSetPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^(.+)-\d+-of-\d+(\.[^.]+)?$`), // model-00001-of-00003.gguf
+	regexp.MustCompile(`^(.+\.[^.]+)-split-[a-z]+$`),  // model.gguf-split-a
+	regexp.MustCompile(`^(.+)\.(?:z\d{2}|zip)$`),      // archive.z01 ... archive.zip
+	regexp.MustCompile(`^(.+)\.part\d+(\.[^.]+)?$`),   // archive.part1.rar, model.bin.part1
+	regexp.MustCompile(`^(.+)\.\d{3}$`),               // archive.7z.001
+}
+
+// splitSetKey returns the name of the split set a file belongs to, or "" when it is not named like a split file
+func splitSetKey(filePath string) string {
+	for i, re := range splitSetPatterns {
+		if m := re.FindStringSubmatch(filePath); m != nil {
+			// the pattern index keeps e.g. x.zip and x.001 in different sets
+			return fmt.Sprint(i, ":", strings.Join(m[1:], ""))
+		}
+	}
+	return ""
+}
+
+// groupSplitSets looks for split file sets the filters only partly selected, with SplitSets the whole set is selected, otherwise it is warned about
+func groupSplitSets(files []hfmodel, silentMode bool) {
+	sets := map[string][]int{}
+	for i := range files {
+		if files[i].IsDirectory {
+			continue
+		}
+		if key := splitSetKey(files[i].Path); key != "" {
+			sets[key] = append(sets[key], i)
+		}
+	}
+	for _, members := range sets {
+		selected := 0
+		for _, i := range members {
+			if !files[i].FilterSkip {
+				selected++
+			}
+		}
+		if len(members) < 2 || selected == 0 || selected == len(members) {
+			continue
+		}
+		if SplitSets {
+			for _, i := range members {
+				files[i].FilterSkip = false
+			}
+			if !silentMode {
+				fmt.Fprintf(Output, "\n%s", infoColor("Selecting the whole split set of ", len(members), " files with: ", files[members[0]].Path))
+			}
+		} else if !silentMode {
+			fmt.Fprintf(Output, "\n%s", warningColor("The filters select only ", selected, " of the ", len(members), " files of the split set of: ", files[members[0]].Path, ", use --splitSets to get the whole set"))
+		}
+	}
+}
+
+// routeDestination returns where the first matching RouteRule puts the file, or "" when no rule matches
+func routeDestination(repoPath string) string {
+	for _, rule := range RouteRules {
+		matched, _ := path.Match(rule.Match, repoPath)
+		if !matched {
+			matched, _ = path.Match(rule.Match, path.Base(repoPath))
+		}
+		if !matched {
+			continue
+		}
+		dir := rule.Dir
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(storageRoot, dir)
+		}
+		return filepath.Join(dir, path.Base(repoPath))
+	}
+	return ""
+}
+
+// EndpointURL returns one of the URL formats above, on Endpoint instead of https://huggingface.co
+func EndpointURL(format string) string {
+	return strings.TrimSuffix(Endpoint, "/") + strings.TrimPrefix(format, DefaultEndpoint)
+}
+
+// DownloadFile downloads a single repo file, only its own folder of the repo tree is listed instead of the whole tree,
+// the file is saved at the same place DownloadModel would put it
+func DownloadFile(ModelDatasetName string, repoPath string, SkipSHA bool, IsDataset bool, DestinationBasePath string, ModelBranch string, concurrentConnections int, token string, silentMode bool) error {
+	savedFiles, savedIncludes := Files, Includes
+	Files, Includes = []string{repoPath}, nil
+	defer func() { Files, Includes = savedFiles, savedIncludes }()
+	modelP := strings.Split(ModelDatasetName, ":")[0] // filters are ignored with Files anyway
+	return DownloadModel(modelP, false, SkipSHA, IsDataset, DestinationBasePath, ModelBranch, concurrentConnections, token, silentMode)
+}
+
+// ResolveAndDownload is DownloadFile returning the absolute local path of the file, like hf_hub_download does,
+// a file already up to date is not downloaded again
+func ResolveAndDownload(ModelDatasetName string, repoPath string, SkipSHA bool, IsDataset bool, DestinationBasePath string, ModelBranch string, concurrentConnections int, token string, silentMode bool) (string, error) {
+	if err := DownloadFile(ModelDatasetName, repoPath, SkipSHA, IsDataset, DestinationBasePath, ModelBranch, concurrentConnections, token, silentMode); err != nil {
+		return "", err
+	}
+	downloaded, upToDate := LocalFiles()
+	if local := append(downloaded, upToDate...); len(local) == 1 {
+		return local[0], nil
+	}
+	return "", fmt.Errorf("%s was not downloaded, it may have been vetoed by FileHook", repoPath)
+}
+
+// filesRoot returns the deepest repo folder holding all of Files, "" for the root
+func filesRoot() string {
+	if len(Files) == 0 || len(Includes) > 0 {
+		return ""
+	}
+	root := path.Dir(strings.Trim(Files[0], "/"))
+	for _, f := range Files[1:] {
+		for root != "." && !strings.HasPrefix(strings.Trim(f, "/"), root+"/") {
+			root = path.Dir(root)
+		}
+	}
+	if root == "." {
+		return ""
+	}
+	return root
+}
+
+// wantedFile reports whether the repo path is one of Files, and records that it exists
+func wantedFile(repoPath string) bool {
+	for _, f := range Files {
+		if strings.Trim(f, "/") == repoPath {
+			filesFound[repoPath] = true
+			return true
+		}
+	}
+	return false
+}
+
+// wantedFolder reports whether one of Files is in the repo folder, or deeper, or whether an include glob could match in there
+func wantedFolder(repoPath string) bool {
+	for _, f := range Files {
+		if strings.HasPrefix(strings.Trim(f, "/"), repoPath+"/") {
+			return true
+		}
+	}
+	folders := strings.Split(repoPath, "/")
+	for _, include := range Includes {
+		segments := strings.Split(strings.Trim(include, "/"), "/")
+		if len(segments) <= len(folders) {
+			continue // the glob has no "/" matching files that deep
+		}
+		matched := true
+		for i, folder := range folders {
+			if ok, _ := path.Match(segments[i], folder); !ok {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// allowlistSkip applies Files and Includes on top of the filters decision: Files are always kept,
+// files matching Includes are kept only when the filters keep them too, and any other file is skipped
+func allowlistSkip(repoPath string, filterSkip bool) bool {
+	if len(Files) == 0 && len(Includes) == 0 {
+		return filterSkip
+	}
+	if wantedFile(repoPath) {
+		return false
+	}
+	for _, include := range Includes {
+		if ok, _ := path.Match(strings.Trim(include, "/"), repoPath); ok {
+			return filterSkip
+		}
+	}
+	return true
+}
+
+// excluded reports whether the repo path matches one of Excludes and is not one of Files
+func excluded(repoPath string) bool {
+	lower := strings.ToLower(repoPath)
+	for _, ex := range Excludes {
+		if filterPatternMatches(ex, lower) {
+			for _, f := range Files {
+				if strings.Trim(f, "/") == repoPath {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// filterFolderName makes a folder name out of a filter, glob characters and path separators are not allowed in names everywhere
+func filterFolderName(filter string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`*?[]/\:<>|"`, r) {
+			return '_'
+		}
+		return r
+	}, filter)
+}
+
+// flatPath is where a file goes in the filter-flat layout, a file name already used by another file of the folder
+// gets the whole repo path with "/" replaced by "_" instead, so both are kept
+func flatPath(folder, repoPath string) string {
+	name := path.Base(repoPath)
+	if owner, taken := flatNames[name]; taken && owner != repoPath {
+		name = strings.ReplaceAll(repoPath, "/", "_")
+	}
+	flatNames[name] = repoPath
+	return path.Join(folder, name)
+}
+
+// maxNameLength is the longest file or folder name most file systems accept, the tmp part names add up to 10 characters to a file name
+const maxNameLength = 255 - 10
+
+// maxPathLength is the longest full path that can be opened, less the same 10 characters of the tmp part names: PATH_MAX,
+// or on Windows the limit of the \\?\ paths Go uses for long absolute paths, MAX_PATH does not apply as the storage path is made absolute
+var maxPathLength = func() int {
+	if runtime.GOOS == "windows" {
+		return 32767 - len(`\\?\`) - 10
+	}
+	return 4096 - 1 - 10
+}()
+
+// checkNameLengths fails early with a clear message on a path with a name too long to be created, instead of a cryptic error mid-download,
+// the names are checked one by one, then the full path once made absolute, as a short storage path can still end up too deep
+func checkNameLengths(filePath string) error {
+	for _, name := range strings.Split(filepath.ToSlash(filePath), "/") {
+		if len(name) > maxNameLength {
+			return fmt.Errorf("\n%s", errorColor("Name too long to be saved (", len(name), " characters, the limit is ", maxNameLength, "): ", filePath))
+		}
+	}
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return err
+	}
+	if len(absPath) > maxPathLength {
+		return fmt.Errorf("\n%s", errorColor("Path too long to be saved (", len(absPath), " characters, the limit is ", maxPathLength, "), use a shorter storage path: ", absPath))
+	}
+	return nil
+}
+
+// fitsOnDisk reports whether downloading the file leaves at least MinFreeBytes free,
+// a multipart download needs room for one extra part, as each part is only removed once merged into the file
+func fitsOnDisk(file hfmodel) (bool, error) {
+	free, err := FreeDiskSpace(path.Dir(file.AppendedPath))
+	if err != nil {
+		return false, err
+	}
+	needed := int64(file.Size) - file.LocalSize
+	if needed < 0 {
+		needed = 0
+	}
+	if file.IsLFS && file.LocalSize == 0 {
+		numParts := NumSplits
+		if numParts <= 0 {
+			numParts = NumConnections
+		}
+		if numParts > 0 {
+			needed += int64(file.Size) / int64(numParts)
+		}
+	}
+	return uint64(needed)+MinFreeBytes <= free, nil
+}
+
+// matchesFilter reports whether the file path is selected by the filters, evaluated in order with the last match winning, case insensitively.
+// A filter starting with "!" excludes instead of includes, if all filters are exclusions every other file is included.
+// Each pattern is matched by filterPatternMatches: without a "/" it matches the file name only, unless MatchFullPath is set.
+func matchesFilter(filePath string, filters []string) bool {
+	filenameLowerCase := strings.ToLower(filePath)
+	selected := true
+	for _, ff := range filters {
+		if !strings.HasPrefix(ff, "!") {
+			selected = false
+			break
+		}
+	}
+	for _, ff := range filters {
+		negate := strings.HasPrefix(ff, "!")
+		pattern := strings.TrimPrefix(ff, "!")
+		if pattern == "" {
+			continue
+		}
+		if filterPatternMatches(pattern, filenameLowerCase) {
+			selected = !negate
+		}
+	}
+	return selected
+}
+
+// filterPatternMatches matches a single filter pattern, without its "!" prefix, against a lower case repo path:
+// a /regex/ is searched in the whole path, ignoring case, a pattern with a "/" is anchored to the whole path (the file itself, or a folder holding it),
+// any other pattern is matched against the file name only, or against the whole path with MatchFullPath
+func filterPatternMatches(pattern string, filePath string) bool {
+	if isRegexFilter(pattern) {
+		re := filterRegexps[pattern]
+		return re != nil && re.MatchString(filePath)
+	}
+	pattern = strings.ToLower(pattern)
+	glob := strings.ContainsAny(pattern, "*?[")
+	if strings.Contains(pattern, "/") {
+		pattern = strings.Trim(pattern, "/")
+		if glob {
+			ok, _ := path.Match(pattern, filePath)
+			return ok
+		}
+		return filePath == pattern || strings.HasPrefix(filePath, pattern+"/")
+	}
+	target := path.Base(filePath)
+	if MatchFullPath {
+		target = filePath
+	}
+	if !glob {
+		return strings.Contains(target, pattern)
+	}
+	ok, _ := path.Match(pattern, target)
+	return ok
+}
+
+// compileFilterRegexps compiles the /regex/ filters of the name:filters argument into filterRegexps, case insensitive with (?i)
+// rather than lower cased, which would turn \D into \d
+func compileFilterRegexps(ModelDatasetName string) error {
+	filterRegexps = map[string]*regexp.Regexp{}
+	_, filters, ok := strings.Cut(ModelDatasetName, ":")
+	patterns := Excludes
+	if ok {
+		patterns = append(splitFilters(filters), Excludes...)
+	}
+	for _, ff := range patterns {
+		pattern := strings.TrimPrefix(ff, "!")
+		if !isRegexFilter(pattern) {
+			continue
+		}
+		re, err := regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+		if err != nil {
+			return fmt.Errorf("invalid regex filter %q: %v", ff, err)
+		}
+		filterRegexps[pattern] = re
+	}
+	return nil
+}
+
+// splitFilters splits the filters of a name:filters argument at the commas, except the commas inside a /regex/ like /q{4,5}_k_m/
+func splitFilters(filters string) []string {
+	pieces := strings.Split(filters, ",")
+	var split []string
+	for i := 0; i < len(pieces); i++ {
+		ff := pieces[i]
+		// a regex cut at one of its commas starts with a "/" without ending with one, it goes on up to the piece closing it
+		if pattern := strings.TrimPrefix(ff, "!"); strings.HasPrefix(pattern, "/") && !isRegexFilter(pattern) {
+			for j := i + 1; j < len(pieces); j++ {
+				if strings.HasSuffix(pieces[j], "/") {
+					ff, i = strings.Join(pieces[i:j+1], ","), j
+					break
+				}
+			}
+		}
+		split = append(split, ff)
+	}
+	return split
+}
+
+// isRegexFilter reports whether a filter pattern is a regular expression, written between slashes like /q[45]_k_m/
+func isRegexFilter(pattern string) bool {
+	return len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/")
+}
+
+// verifyMode returns the verification to apply on a file, "sha256", "size" or "etag", VerifyOverrides take precedence over SkipSHA,
+// they are tried in the order given and the first match wins
+func verifyMode(file hfmodel, SkipSHA bool) string {
+	for _, override := range VerifyOverrides {
+		if matched, _ := path.Match(override.Match, file.Path); matched {
+			return override.Mode
+		}
+	}
+	if file.IsLFS && !SkipSHA {
+		return "sha256"
+	}
+	return "size"
+}
+
+// existingVerifyMode is verifyMode for a file already on disk, VerifyExisting can force or disable hashing before it is skipped
+func existingVerifyMode(file hfmodel, SkipSHA bool) string {
+	switch VerifyExisting {
+	case "off":
+		return "size"
+	case "all":
+		return "sha256"
+	}
+	return verifyMode(file, SkipSHA)
+}
+
+// normalizeETag drops the quotes and the weak W/ prefix of an ETag, so a weak and a strong ETag of the same content compare equal
+func normalizeETag(etag string) string {
+	return strings.Trim(strings.TrimPrefix(strings.TrimSpace(etag), "W/"), `"`)
+}
+
+// remoteETag returns the current ETag of a repo file, normalized
+func remoteETag(file hfmodel) (string, error) {
+	url := file.DownloadLink
+	if file.ResolverURL != "" {
+		url = file.ResolverURL // signed links expire, the resolver gives a fresh one
+	}
+	client, err := NewHTTPClient()
+	if err != nil {
+		return "", err
+	}
+	_, etag, _, err := probeSize(client, url)
+	if err != nil {
+		return "", err
+	}
+	etag = normalizeETag(etag)
+	if etag == "" {
+		return "", fmt.Errorf("\n%s", errorColor("No ETag for ", file.Path, ", it can't be verified with the etag mode"))
+	}
+	return etag, nil
+}
+
+// verifyGitOid checks a file against its git blob oid, which is sha1("blob <size>\x00" + content)
+func verifyGitOid(filePath, expectedOid string) error {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
 
-	hasher := sha256.New()
+	hasher := sha1.New()
+	fmt.Fprintf(hasher, "blob %d\x00", fileInfo.Size())
 	if _, err := io.Copy(hasher, file); err != nil {
 		return err
 	}
 
-	actualChecksum := hex.EncodeToString(hasher.Sum(nil))
-	if actualChecksum != expectedChecksum {
-		return fmt.Errorf("\n%s", errorColor("checksum mismatch: expected ", expectedChecksum, "got ", actualChecksum))
+	actualOid := hex.EncodeToString(hasher.Sum(nil))
+	if actualOid != expectedOid {
+		return fmt.Errorf("\n%s", errorColor("git oid mismatch: expected ", expectedOid, "got ", actualOid))
 	}
 
 	return nil
 }
 
-func downloadChunk(tempFolder string, outputFileName string, idx int, url string, start, end int64, progress chan<- int64) error {
-	tmpFileName := path.Join(tempFolder, fmt.Sprintf("%s_%d.tmp", outputFileName, idx))
+func downloadChunk(tempFolder string, outputFileName string, idx int, url string, etag string, start, end int64, progress chan<- partProgress, received *transfer) error {
+	tmpFileName := partPath(tempFolder, outputFileName, idx)
 	var compensationBytes int64 = 12
+	partLength := end - start
+	var reported int64 // bytes of this part already reflected in progress
 
 	// Checking file if exists
 	if fi, err := os.Stat(tmpFileName); err == nil { // file exists
 		// If file is already completely downloaded
 		if fi.Size() == (end - start) {
 			// Reflect progress and return
-			progress <- fi.Size()
+			progress <- partProgress{idx, fi.Size()}
 			return nil
 		}
 
-		// Fetching size to adjust start byte and compensate for potential corruption
-		start = int64(math.Max(float64(start+fi.Size()-compensationBytes), 0.0))
+		// Fetching size to adjust start byte and compensate for potential corruption, a part smaller than that restarts from its beginning
+		if fi.Size() > compensationBytes {
+			start += fi.Size() - compensationBytes
 
-		// Reflecting skipped part in progress, minus compensationBytes so we download them again. Making sure it does not go negative
-		progress <- int64(math.Max(float64(fi.Size()-compensationBytes), 0.0))
+			// Reflecting skipped part in progress, minus compensationBytes so we download them again
+			reported = fi.Size() - compensationBytes
+			progress <- partProgress{idx, reported}
+		}
 	}
 
-	client := &http.Client{
-		Transport: &http.Transport{},
+	client, err := newChunkClient()
+	if err != nil {
+		return err
 	}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
@@ -563,6 +1749,10 @@ func downloadChunk(tempFolder string, outputFileName string, idx int, url string
 	// Updating the Range header
 	rangeHeader := fmt.Sprintf("bytes=%d-%d", start, end-1)
 	req.Header.Add("Range", rangeHeader)
+	// If-Range makes the server answer 200 instead of 206 when the file changed, weak validators are not allowed there
+	if reported > 0 && etag != "" && !strings.HasPrefix(etag, "W/") {
+		req.Header.Add("If-Range", etag)
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
@@ -573,6 +1763,39 @@ func downloadChunk(tempFolder string, outputFileName string, idx int, url string
 	if resp.StatusCode == 401 && !RequiresAuth {
 		return fmt.Errorf("\n%s", errorColor("This Repo requires an access token, generate an access token form huggingface, and pass it using flag: -t TOKEN"))
 	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// the part may already cover its whole range (e.g. it grew past it), in that case the bytes are already here
+		fi, err := os.Stat(tmpFileName)
+		if err != nil || fi.Size() < partLength {
+			return fmt.Errorf("\n%s", errorColor("Requested range not satisfiable for chunk ", idx, ": ", rangeHeader))
+		}
+		if err := os.Truncate(tmpFileName, partLength); err != nil {
+			return err
+		}
+		progress <- partProgress{idx, partLength - reported}
+		return nil
+	}
+	if resp.StatusCode == http.StatusOK {
+		// the whole file instead of our range, either the file changed since this part was started or ranges are ignored
+		os.Remove(tmpFileName)
+		return fmt.Errorf("\n%s", errorColor("Server did not return the requested range for chunk ", idx, ", the remote file may have changed, the part was discarded"))
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		progress <- partProgress{idx, -reported} // the part is tried again with a fresh link, which reports these bytes again
+		return fmt.Errorf("%w: %v", errLinkExpired, statusError(resp))
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return statusError(resp)
+	}
+	// appending bytes from anywhere else than asked would corrupt the part silently
+	var gotStart, gotEnd int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d", &gotStart, &gotEnd); err != nil || gotStart != start || gotEnd != end-1 {
+		progress <- partProgress{idx, -reported} // the retry reports these bytes again
+		return fmt.Errorf("\n%s", errorColor("Server returned range ", resp.Header.Get("Content-Range"), " for chunk ", idx, ", expected ", rangeHeader))
+	}
+	if err := checkNotHTML(resp, outputFileName); err != nil {
+		return err
+	}
 
 	// Open the file to append/add the new content
 	tempFile, err := os.OpenFile(tmpFileName, os.O_CREATE|os.O_RDWR, 0644)
@@ -592,6 +1815,7 @@ func downloadChunk(tempFolder string, outputFileName string, idx int, url string
 	}
 
 	buffer := make([]byte, 32768)
+	limiter := &connLimiter{}
 	for {
 		bytesRead, err := resp.Body.Read(buffer)
 		if err != nil && err != io.EOF {
@@ -601,131 +1825,361 @@ func downloadChunk(tempFolder string, outputFileName string, idx int, url string
 		if bytesRead == 0 {
 			break
 		}
+		limiter.wait(bytesRead)
+		received.addBytes(int64(bytesRead))
 
 		_, err = tempFile.Write(buffer[:bytesRead])
 		if err != nil {
 			return err
 		}
 
-		progress <- int64(bytesRead)
+		progress <- partProgress{idx, int64(bytesRead)}
 	}
 
 	return nil
 }
 
 func mergeFiles(tempFolder, outputFileName string, numChunks int) error {
+	rememberStreamedHash(outputFileName, "")
 	outputFile, err := os.Create(outputFileName)
 	if err != nil {
 		return err
 	}
 	defer outputFile.Close()
 
+	// parts are copied, not moved, so they can be on another disk than the output file, and hashed on the way
+	hasher := sha256.New()
+	merged := io.MultiWriter(outputFile, hasher)
 	for i := 0; i < numChunks; i++ {
-		tmpFileName := fmt.Sprintf("%s_%d.tmp", path.Base(outputFileName), i)
-		tempFileName := path.Join(tempFolder, tmpFileName)
-		tempFiles, err := os.ReadDir(tempFolder)
+		tempFileName := partPath(tempFolder, path.Base(outputFileName), i)
+		tempFile, err := os.Open(tempFileName)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(merged, tempFile)
+		if err != nil {
+			return err
+		}
+		err = tempFile.Close()
+		if err != nil {
+			return err
+		}
+		err = os.Remove(tempFileName)
 		if err != nil {
 			return err
 		}
-		for _, file := range tempFiles {
+	}
+	for _, dir := range partFolders(tempFolder) {
+		if dir != tempFolder {
+			os.Remove(dir) // only removed once empty, other files may still have parts in it
+		}
+	}
+	rememberStreamedHash(outputFileName, hex.EncodeToString(hasher.Sum(nil)))
+	return nil
+}
 
-			if matched, _ := filepath.Match(tempFileName, path.Join(tempFolder, file.Name())); matched {
-				tempFile, err := os.Open(path.Join(tempFolder, file.Name()))
-				if err != nil {
-					return err
-				}
-				_, err = io.Copy(outputFile, tempFile)
-				if err != nil {
-					return err
-				}
-				err = tempFile.Close()
-				if err != nil {
-					return err
-				}
-				err = os.Remove(path.Join(tempFolder, file.Name()))
-				if err != nil {
-					return err
-				}
+// partFolders returns the folders the parts of the files of tempFolder are stored in, a subfolder per repo folder in each of PartDirs when set
+func partFolders(tempFolder string) []string {
+	if len(PartDirs) == 0 {
+		return []string{tempFolder}
+	}
+	// files of different repos often share names, so each tmp folder gets its own subfolder
+	sum := sha1.Sum([]byte(tempFolder))
+	folders := make([]string, len(PartDirs))
+	for i, dir := range PartDirs {
+		folders[i] = filepath.Join(dir, "hfd_"+hex.EncodeToString(sum[:6]))
+	}
+	return folders
+}
+
+// partPath is where part idx of a file is stored
+func partPath(tempFolder, baseFileName string, idx int) string {
+	folders := partFolders(tempFolder)
+	return filepath.Join(folders[idx%len(folders)], fmt.Sprintf("%s_%d.tmp", baseFileName, idx))
+}
+
+// partIndex returns the index of a part file of baseFileName, ok is false for files of other downloads
+func partIndex(partFile, baseFileName string) (idx int, ok bool) {
+	name := filepath.Base(partFile)
+	if !strings.HasPrefix(name, baseFileName+"_") || !strings.HasSuffix(name, ".tmp") {
+		return 0, false
+	}
+	idx, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, baseFileName+"_"), ".tmp"))
+	return idx, err == nil && idx >= 0
+}
+
+// ownParts drops the files the part glob matched that belong to another download, e.g. "a_b_0.tmp" for the file "a"
+func ownParts(matches []string, baseFileName string) []string {
+	var own []string
+	for _, match := range matches {
+		if _, ok := partIndex(match, baseFileName); ok {
+			own = append(own, match)
+		}
+	}
+	return own
+}
+
+// partsComplete reports whether the parts are exactly the indexes 0 to len(parts)-1
+func partsComplete(parts []string, baseFileName string) bool {
+	seen := make([]bool, len(parts))
+	for _, part := range parts {
+		idx, _ := partIndex(part, baseFileName)
+		if idx >= len(parts) || seen[idx] {
+			return false
+		}
+		seen[idx] = true
+	}
+	return true
+}
+
+// probeSize gets the size and ETag of a remote file with a HEAD request, some mirrors reject HEAD or leave out its Content-Length,
+// then a 1 byte range GET is sent instead and the size is read from the total of its Content-Range.
+// ranges reports whether the server may serve range requests, which splitting the file in parts needs
+func probeSize(client *http.Client, url string) (contentLength int, etag string, ranges bool, err error) {
+	resp, err := sizeRequest(client, "HEAD", url)
+	if err != nil {
+		return 0, "", false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == 401 && !RequiresAuth {
+		return 0, "", false, fmt.Errorf("\n%s", errorColor("This Repo requires access token, generate an access token form huggingface, and pass it using flag: -t TOKEN"))
+	}
+	if resp.StatusCode < 300 {
+		if contentLength, err := strconv.Atoi(resp.Header.Get("Content-Length")); err == nil {
+			return contentLength, resp.Header.Get("ETag"), resp.Header.Get("Accept-Ranges") != "none", nil
+		}
+	}
+
+	resp, err = sizeRequest(client, "GET", url)
+	if err != nil {
+		return 0, "", false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return 0, "", false, statusError(resp)
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-0/<total>
+		contentRange := resp.Header.Get("Content-Range")
+		if i := strings.LastIndex(contentRange, "/"); i >= 0 {
+			if contentLength, err := strconv.Atoi(contentRange[i+1:]); err == nil {
+				return contentLength, resp.Header.Get("ETag"), true, nil
 			}
 		}
+	case http.StatusOK:
+		// range ignored, the whole file is on its way, its length is all we need
+		if contentLength, err := strconv.Atoi(resp.Header.Get("Content-Length")); err == nil {
+			return contentLength, resp.Header.Get("ETag"), false, nil
+		}
 	}
-	return nil
+	return 0, "", false, fmt.Errorf("could not get the size of %s, HEAD and range request status: %s", url, resp.Status)
 }
 
-func downloadFileMultiThread(tempFolder, url, outputFileName string, silentMode bool) error {
-	client := &http.Client{}
-	req, err := http.NewRequest("HEAD", url, nil)
+// sizeRequest sends the HEAD, or the 1 byte range GET, used by probeSize
+func sizeRequest(client *http.Client, method, url string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, nil)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if method == "GET" {
+		req.Header.Set("Range", "bytes=0-0")
 	}
 	if RequiresAuth {
 		// Set the authorization header with the Bearer token
-		bearerToken := AuthToken
-		req.Header.Add("Authorization", "Bearer "+bearerToken)
+		req.Header.Add("Authorization", "Bearer "+AuthToken)
 	}
-	resp, err := client.Do(req)
+	return client.Do(req)
+}
+
+// errLinkExpired is a 403 from the server a signed download link points to, the link likely expired during a long download
+var errLinkExpired = errors.New("download link rejected, it may have expired")
+
+// signedLink is the download link shared by the parts of a file, a part getting errLinkExpired refreshes it for all of them
+type signedLink struct {
+	mu          sync.Mutex
+	url         string
+	resolverURL string
+}
+
+func (l *signedLink) get() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.url
+}
+
+// refresh resolves a fresh link, unless another part already replaced the expired one
+func (l *signedLink) refresh(expired string) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.url != expired {
+		return l.url, nil
+	}
+	if l.resolverURL == "" {
+		return "", errLinkExpired
+	}
+	fresh, err := getRedirectLink(l.resolverURL)
 	if err != nil {
-		return err
+		return "", err
 	}
-	if resp.StatusCode == 401 && !RequiresAuth {
-		return fmt.Errorf("\n%s", errorColor("This Repo requires access token, generate an access token form huggingface, and pass it using flag: -t TOKEN"))
+	l.url = fresh
+	return fresh, nil
+}
 
+func downloadFileMultiThread(tempFolder, url, resolverURL, outputFileName string, silentMode bool) error {
+	client, err := NewHTTPClient()
+	if err != nil {
+		return err
 	}
-	contentLength, err := strconv.Atoi(resp.Header.Get("Content-Length"))
+	contentLength, etag, ranges, err := probeSize(client, url)
 	if err != nil {
 		return err
 	}
 
-	chunkSize := int64(contentLength / NumConnections)
-
-	progress := make(chan int64, NumConnections)
+	// the file is split in numParts ranges, and at most NumConnections of them are downloaded at the same time
+	numParts := NumSplits
+	if numParts <= 0 {
+		numParts = NumConnections
+	}
+	fallbackReason := ""
+	switch {
+	case !ranges:
+		fallbackReason = "the server does not support range requests"
+	case contentLength < numParts:
+		fallbackReason = fmt.Sprintf("the file is smaller than %d bytes", numParts)
+	}
+	if fallbackReason != "" {
+		if !silentMode {
+			fmt.Fprintf(Output, "\n%s", infoColor("Multipart unavailable for ", path.Base(outputFileName), ": ", fallbackReason, ", using a single connection"))
+		}
+		return downloadSingleThreaded(url, outputFileName, int64(contentLength))
+	}
 
 	// update 1.2.5; we need to check now, if the tmp folder does exists, if the number of files exists before, matched the number of connection, we can proceed with the logic of resuming
 	// Calculate the temp file name pattern.
 	baseFileName := path.Base(outputFileName)
-	tmpFileNamePattern := filepath.Join(tempFolder, fmt.Sprintf("%s_*.tmp", baseFileName))
+	var matches []string
+	for _, folder := range partFolders(tempFolder) {
+		if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+			return err
+		}
+		tmpFileNamePattern := filepath.Join(folder, fmt.Sprintf("%s_*.tmp", baseFileName))
 
-	// Use Glob to find all files that match this pattern.
-	matches, err := filepath.Glob(tmpFileNamePattern)
-	if err != nil {
+		// Use Glob to find all files that match this pattern.
+		folderMatches, err := filepath.Glob(tmpFileNamePattern)
+		if err != nil {
+			if !silentMode {
+				fmt.Fprintln(Output, err)
+			}
+			return err
+		}
+		matches = append(matches, folderMatches...)
+	}
+	matches = ownParts(matches, baseFileName)
+	// parts left by a run with another number of parts, or with a part missing, can't be resumed, the ranges would not line up
+	if len(matches) > 0 && !partsComplete(matches, baseFileName) {
 		if !silentMode {
-			fmt.Println(err)
+			fmt.Fprintf(Output, "\n%s", warningColor("Incomplete download parts don't match, restarting: ", baseFileName))
 		}
-		return err
+		for _, match := range matches {
+			if err := os.Remove(match); err != nil {
+				return err
+			}
+		}
+		matches = nil
 	}
 
+	// an incomplete download of an older version of the file can't be resumed, the parts would mix old and new content
+	etagFile := path.Join(tempFolder, baseFileName+".etag")
+	if len(matches) > 0 && etag != "" {
+		if previousEtag, err := os.ReadFile(etagFile); err == nil && string(previousEtag) != etag {
+			if !silentMode {
+				fmt.Fprintf(Output, "\n%s", warningColor("Remote file changed since the incomplete download, restarting: ", baseFileName))
+			}
+			for _, match := range matches {
+				if err := os.Remove(match); err != nil {
+					return err
+				}
+			}
+			matches = nil
+		}
+	}
+	if etag != "" {
+		if err := os.WriteFile(etagFile, []byte(etag), 0644); err != nil {
+			return err
+		}
+	}
 	// Print the number of matched files.
 	// count := len(matches)
 	if len(matches) > 0 {
 		if !silentMode {
-			fmt.Printf("\n%s", infoColor("Found existing incomplete download for the file: ", baseFileName, "\nForcing Number of connections to: ", len(matches), "\n\n"))
+			fmt.Fprintf(Output, "\n%s", infoColor("Found existing incomplete download for the file: ", baseFileName, "\nForcing Number of parts to: ", len(matches), "\n\n"))
 		}
-		NumConnections = len(matches)
+		numParts = len(matches)
 	}
+	chunkSize := int64(contentLength / numParts)
+
+	// create every part up front, so an interrupted download always leaves numParts files behind to resume from
+	for i := 0; i < numParts; i++ {
+		tmpFile, err := os.OpenFile(partPath(tempFolder, baseFileName, i), os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		tmpFile.Close()
+	}
+
+	progress := make(chan partProgress, numParts)
+	connections := make(chan struct{}, NumConnections)
 	wg := &sync.WaitGroup{}
 
-	errChan := make(chan error)
+	errChan := make(chan error, numParts) // buffered, so parts failing after we stop listening don't block forever
+	link := &signedLink{url: url, resolverURL: resolverURL}
+	received := transferFor(outputFileName)
 
-	for i := 0; i < NumConnections; i++ {
+	for i := 0; i < numParts; i++ {
 		start := int64(i) * chunkSize
 		end := start + chunkSize
 
-		if i == NumConnections-1 {
+		if i == numParts-1 {
 			end = int64(contentLength)
 		}
+		// later parts wait for a free connection anyway, only the first burst needs spreading
+		if RampUp && i > 0 && i < NumConnections {
+			time.Sleep(RampUpStep)
+		}
 		wg.Add(1)
 		go func(i int, start, end int64) {
-			err := downloadChunk(tempFolder, path.Base(outputFileName), i, url, start, end, progress)
+			defer wg.Done() // runs after the recover below, prevent panic send on closed channel
+			// a panic in a part becomes an error for this file instead of crashing, the part is emptied since its content can't be trusted,
+			// removing it would leave an incomplete set of parts and the next run would throw the other parts away too
+			defer func() {
+				if r := recover(); r != nil {
+					<-connections
+					os.Truncate(partPath(tempFolder, baseFileName, i), 0)
+					if !silentMode {
+						fmt.Fprintf(Output, "\n%s\n%s", errorColor("panic downloading chunk ", i, ": ", r), debug.Stack())
+					}
+					errChan <- fmt.Errorf("\n%s", errorColor("panic downloading chunk ", i, ": ", r))
+				}
+			}()
+			connections <- struct{}{}
+			used := link.get()
+			err := downloadChunk(tempFolder, path.Base(outputFileName), i, used, etag, start, end, progress, received)
+			if errors.Is(err, errLinkExpired) {
+				var fresh string
+				if fresh, err = link.refresh(used); err == nil {
+					trackTransfer(outputFileName, func(t *transfer) { t.refreshes++ })
+					err = downloadChunk(tempFolder, path.Base(outputFileName), i, fresh, etag, start, end, progress, received)
+				}
+			}
+			<-connections
 			if err != nil {
-				errChan <- fmt.Errorf("\n%s", errorColor("error downloading chunk ", i, ":", err))
+				errChan <- fmt.Errorf("\n%s%w", errorColor("error downloading chunk ", i, ":"), err) // %w keeps RetryDelay working
 			}
-
-			wg.Done() // prevent panic send on closed channel
 		}(i, start, end)
 	}
 	// Mark the start time of the download
 	if !silentMode { // TODO: check if we change later to always printing regardless of silent or non silent mode
-		fmt.Printf("\nStart Downloading: %s", outputFileName)
+		fmt.Fprintf(Output, "\nStart Downloading: %s", outputFileName)
 	}
 	startTime := time.Now()
 	go func() {
@@ -740,10 +2194,15 @@ func downloadFileMultiThread(tempFolder, url, outputFileName string, silentMode
 			rateCheckpoints[i].time = startTime
 		}
 
-		fmt.Printf("\n\n")
-		for chunkSize := range progress {
+		partsDownloaded := make([]int64, numParts)
+
+		if !silentMode {
+			fmt.Fprintf(Output, "\n\n")
+		}
+		for p := range progress {
 			now := time.Now()
-			totalDownloaded += chunkSize
+			totalDownloaded += p.bytes
+			partsDownloaded[p.idx] += p.bytes
 
 			if now.Sub(rateCheckpoints[len(rateCheckpoints)-2].time) >= 1*time.Second {
 				for i := 1; i < len(rateCheckpoints); i++ {
@@ -760,7 +2219,20 @@ func downloadFileMultiThread(tempFolder, url, outputFileName string, silentMode
 			speed := float64(rateCheckpoints[len(rateCheckpoints)-1].bytes-rateCheckpoints[0].bytes) / (1024 * 1024) / elapsed
 			if !silentMode {
 				if time.Since(lastPrintTime).Seconds() >= 0.1 || totalDownloaded == int64(contentLength) {
-					fmt.Printf("\rDownloading %s Speed: %.2f MB/sec, %.2f%% ", outputFileName, speed, float64(totalDownloaded*100)/float64(contentLength))
+					partsLine := ""
+					if ShowPartProgress {
+						partsLine = "parts:"
+						for i, downloaded := range partsDownloaded {
+							partSize := chunkSize
+							if i == len(partsDownloaded)-1 {
+								partSize = int64(contentLength) - chunkSize*int64(i)
+							}
+							if partSize > 0 {
+								partsLine += fmt.Sprintf(" %d:%.0f%%", i, float64(downloaded*100)/float64(partSize))
+							}
+						}
+					}
+					fmt.Fprintf(Output, "\rDownloading %s Speed: %.2f MB/sec, %.2f%% %s", outputFileName, speed, float64(totalDownloaded*100)/float64(contentLength), partsLine)
 					lastPrintTime = time.Now()
 				}
 			}
@@ -776,7 +2248,7 @@ func downloadFileMultiThread(tempFolder, url, outputFileName string, silentMode
 	for err := range errChan {
 		if err != nil {
 			if !silentMode {
-				fmt.Println(err) // Or however you want to handle the error
+				fmt.Fprintln(Output, err) // Or however you want to handle the error
 			}
 			// Here you can choose to return, exit, or however you want to stop going forward
 			return err
@@ -785,18 +2257,51 @@ func downloadFileMultiThread(tempFolder, url, outputFileName string, silentMode
 
 	// fmt.Print("\nDownload completed")
 	if !silentMode {
-		fmt.Printf("\nMerging %s Chunks", outputFileName)
+		fmt.Fprintf(Output, "\nMerging %s Chunks", outputFileName)
+	}
+	// a part cut short by the server would only show up as a hash failure later, or not at all without one
+	for i := 0; i < numParts; i++ {
+		expected := chunkSize
+		if i == numParts-1 {
+			expected = int64(contentLength) - int64(i)*chunkSize
+		}
+		fi, err := os.Stat(partPath(tempFolder, baseFileName, i))
+		if err != nil {
+			return err
+		}
+		if fi.Size() != expected {
+			if fi.Size() > expected {
+				os.Remove(partPath(tempFolder, baseFileName, i)) // a short part is resumed next time, a long one can't be trusted
+			}
+			return fmt.Errorf("\n%s", errorColor("Part ", i, " of ", baseFileName, " has ", fi.Size(), " bytes, expected ", expected))
+		}
 	}
-	err = mergeFiles(tempFolder, outputFileName, NumConnections)
+	err = mergeFiles(tempFolder, outputFileName, numParts)
 	if err != nil {
 		return err
 	}
+	if fi, err := os.Stat(outputFileName); err != nil {
+		return err
+	} else if fi.Size() != int64(contentLength) {
+		os.Remove(outputFileName)
+		return fmt.Errorf("\n%s", errorColor("Merged file size mismatch: ", outputFileName, ", filesize: ", fi.Size(), " Needed Size: ", contentLength))
+	}
+	os.Remove(etagFile)
+	trackTransfer(outputFileName, func(t *transfer) {
+		t.multipart, t.etag = true, etag
+		if atomic.LoadInt64(&t.bytes) > 0 {
+			t.status = http.StatusPartialContent
+		}
+	})
 	if !silentMode { // TODO: check if we change later to always printing regardless of silent or non silent mode
-		fmt.Printf("\nFinished Downloading: %s", outputFileName)
+		fmt.Fprintf(Output, "\nFinished Downloading: %s", outputFileName)
 	}
 	return nil
 }
-func downloadSingleThreaded(url, outputFileName string) error {
+
+// downloadSingleThreaded downloads the whole file in one request, size is the size of the file in the repo file list, -1 when unknown
+func downloadSingleThreaded(url, outputFileName string, size int64) error {
+	rememberStreamedHash(outputFileName, "")
 	outputFile, err := os.Create(outputFileName)
 
 	if err != nil {
@@ -806,7 +2311,10 @@ func downloadSingleThreaded(url, outputFileName string) error {
 
 	// Set the authorization header with the Bearer token
 
-	client := &http.Client{}
+	client, err := NewHTTPClient()
+	if err != nil {
+		return err
+	}
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err // gracefully handle request err
@@ -826,11 +2334,94 @@ func downloadSingleThreaded(url, outputFileName string) error {
 		return fmt.Errorf(errorColor("This Repo requires access token, generate an access token form huggingface, and pass it using flag: -t TOKEN"))
 
 	}
-	_, err = io.Copy(outputFile, resp.Body)
-	if err != nil {
+	if resp.StatusCode >= 300 {
+		return statusError(resp)
+	}
+	if err := checkNotHTML(resp, outputFileName); err != nil {
 		return err
 	}
+	trackTransfer(outputFileName, func(t *transfer) { t.status, t.etag = resp.StatusCode, resp.Header.Get("ETag") })
+	hasher := sha256.New()
+	if err := copyBody(outputFile, resp, hasher, size); err != nil {
+		return err
+	}
+	rememberStreamedHash(outputFileName, hex.EncodeToString(hasher.Sum(nil)))
 
 	// fmt.Println("\nDownload completed")
 	return nil
 }
+
+// resumeSingleThreaded appends the missing tail of an existing file of the given size, starting at offset, a server ignoring the range gets the whole file written again
+func resumeSingleThreaded(url, outputFileName string, offset, size int64) error {
+	rememberStreamedHash(outputFileName, "") // only the tail is written, the file is read again to be hashed
+	client, err := NewHTTPClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if RequiresAuth {
+		req.Header.Add("Authorization", "Bearer "+AuthToken)
+	}
+	req.Header.Add("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 401 && !RequiresAuth {
+		return fmt.Errorf(errorColor("This Repo requires access token, generate an access token form huggingface, and pass it using flag: -t TOKEN"))
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w: %v", errLinkExpired, statusError(resp))
+	}
+	if resp.StatusCode >= 300 {
+		return statusError(resp)
+	}
+	if err := checkNotHTML(resp, outputFileName); err != nil {
+		return err
+	}
+
+	trackTransfer(outputFileName, func(t *transfer) { t.status, t.etag = resp.StatusCode, resp.Header.Get("ETag") })
+	flags := os.O_WRONLY | os.O_APPEND
+	if resp.StatusCode != http.StatusPartialContent {
+		flags = os.O_WRONLY | os.O_TRUNC
+	}
+	outputFile, err := os.OpenFile(outputFileName, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+
+	if resp.StatusCode == http.StatusPartialContent && size >= 0 {
+		size -= offset
+	}
+	return copyBody(outputFile, resp, nil, size)
+}
+
+// copyBody writes a response body to the file, and to hasher too unless nil, expected is the number of bytes the body should hold
+// according to the repo file list, the Content-Length is trusted instead when it is -1,
+// a body ending early is an error to retry on, not a short file, and so is a longer body, the file changed since it was listed
+func copyBody(outputFile *os.File, resp *http.Response, hasher hash.Hash, expected int64) error {
+	if expected < 0 {
+		expected = resp.ContentLength
+	}
+	var dst io.Writer = outputFile
+	if hasher != nil {
+		dst = io.MultiWriter(outputFile, hasher)
+	}
+	written, err := io.Copy(dst, rateLimitedReader{resp.Body, &connLimiter{}})
+	transferFor(outputFile.Name()).addBytes(written)
+	if err == nil && expected >= 0 && written < expected {
+		err = io.ErrUnexpectedEOF
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("\n%s", errorColor("Connection closed early for ", outputFile.Name(), ": ", written, " of ", expected, " bytes received"))
+	}
+	if err == nil && expected >= 0 && written > expected {
+		return fmt.Errorf("\n%s", errorColor("Received ", written, " bytes for ", outputFile.Name(), ", ", expected, " expected, the file may have changed since it was listed"))
+	}
+	return err
+}
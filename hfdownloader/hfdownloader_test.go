@@ -0,0 +1,976 @@
+package hfdownloader
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRepo serves the model repo o/r on branch main like huggingface.co does: the tree API, raw files,
+// and LFS files through a resolve redirect to a blob URL supporting ranges
+type fakeRepo struct {
+	*httptest.Server
+	mu    sync.Mutex
+	files map[string][]byte
+	lfs   map[string]bool
+	// serve, when set, is tried first and reports whether it handled the request
+	serve func(w http.ResponseWriter, r *http.Request) bool
+}
+
+// newFakeRepo starts a fake repo and points Endpoint at it, paths of lfs are served as LFS files
+func newFakeRepo(t *testing.T, files map[string][]byte, lfs ...string) *fakeRepo {
+	t.Helper()
+	repo := &fakeRepo{files: files, lfs: map[string]bool{}}
+	for _, p := range lfs {
+		repo.lfs[p] = true
+	}
+	repo.Server = httptest.NewServer(http.HandlerFunc(repo.handle))
+	Endpoint = repo.URL
+	t.Cleanup(func() {
+		repo.Close()
+		Endpoint = DefaultEndpoint
+	})
+	return repo
+}
+
+// setFile replaces the content of a file, as a new commit would
+func (repo *fakeRepo) setFile(p string, content []byte) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	repo.files[p] = content
+}
+
+func (repo *fakeRepo) file(p string) ([]byte, bool) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	content, ok := repo.files[p]
+	return content, ok
+}
+
+func (repo *fakeRepo) handle(w http.ResponseWriter, r *http.Request) {
+	if repo.serve != nil && repo.serve(w, r) {
+		return
+	}
+	p := r.URL.Path
+	switch {
+	case strings.HasPrefix(p, "/api/models/o/r/tree/main"):
+		json.NewEncoder(w).Encode(repo.tree(strings.Trim(strings.TrimPrefix(p, "/api/models/o/r/tree/main"), "/")))
+	case strings.HasPrefix(p, "/o/r/raw/main/"):
+		repo.serveFile(w, r, strings.TrimPrefix(p, "/o/r/raw/main/"))
+	case strings.HasPrefix(p, "/o/r/resolve/main/"):
+		http.Redirect(w, r, repo.URL+"/blob/"+strings.TrimPrefix(p, "/o/r/resolve/main/"), http.StatusFound)
+	case strings.HasPrefix(p, "/blob/"):
+		repo.serveFile(w, r, strings.TrimPrefix(p, "/blob/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveFile answers HEAD, GET and range requests, with an ETag that changes with the content
+func (repo *fakeRepo) serveFile(w http.ResponseWriter, r *http.Request, p string) {
+	content, ok := repo.file(p)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	sum := sha256.Sum256(content)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+	http.ServeContent(w, r, path.Base(p), time.Time{}, bytes.NewReader(content))
+}
+
+// tree lists the files and folders directly in folder
+func (repo *fakeRepo) tree(folder string) []map[string]any {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	prefix := ""
+	if folder != "" {
+		prefix = folder + "/"
+	}
+	var names []string
+	for p := range repo.files {
+		if strings.HasPrefix(p, prefix) {
+			names = append(names, p)
+		}
+	}
+	sort.Strings(names)
+	list := []map[string]any{}
+	seen := map[string]bool{}
+	for _, p := range names {
+		if sub, _, nested := strings.Cut(strings.TrimPrefix(p, prefix), "/"); nested {
+			if !seen[sub] {
+				seen[sub] = true
+				list = append(list, map[string]any{"type": "directory", "path": prefix + sub, "size": 0, "oid": "0"})
+			}
+			continue
+		}
+		content := repo.files[p]
+		entry := map[string]any{"type": "file", "path": p, "size": len(content), "oid": gitOid(content)}
+		if repo.lfs[p] {
+			sum := sha256.Sum256(content)
+			entry["lfs"] = map[string]any{"oid": hex.EncodeToString(sum[:]), "size": len(content), "pointerSize": 134}
+		}
+		list = append(list, entry)
+	}
+	return list
+}
+
+func gitOid(content []byte) string {
+	hasher := sha1.New()
+	fmt.Fprintf(hasher, "blob %d\x00", len(content))
+	hasher.Write(content)
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func TestVerifyModeOverrides(t *testing.T) {
+	defer func() { VerifyOverrides = nil }()
+	lfs := &hflfs{Oid_SHA265: "x"}
+	tests := []struct {
+		name      string
+		overrides []VerifyOverride
+		file      hfmodel
+		skipSHA   bool
+		want      string
+	}{
+		{"lfs default", nil, hfmodel{Path: "model.bin", Lfs: lfs, IsLFS: true}, false, "sha256"},
+		{"lfs skip sha", nil, hfmodel{Path: "model.bin", Lfs: lfs, IsLFS: true}, true, "size"},
+		{"non-lfs default", nil, hfmodel{Path: "config.json"}, false, "size"},
+		{"override beats skip sha", []VerifyOverride{{"*.bin", "sha256"}}, hfmodel{Path: "model.bin", Lfs: lfs, IsLFS: true}, true, "sha256"},
+		{"no match", []VerifyOverride{{"*.json", "sha256"}}, hfmodel{Path: "model.bin"}, false, "size"},
+		{"first match wins", []VerifyOverride{{"*.json", "etag"}, {"config.*", "sha256"}}, hfmodel{Path: "config.json"}, false, "etag"},
+		{"order given, not spelling", []VerifyOverride{{"config.*", "sha256"}, {"*.json", "etag"}}, hfmodel{Path: "config.json"}, false, "sha256"},
+		{"glob on the whole path", []VerifyOverride{{"onnx/*", "sha256"}}, hfmodel{Path: "onnx/model.json"}, false, "sha256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			VerifyOverrides = tt.overrides
+			if got := verifyMode(tt.file, tt.skipSHA); got != tt.want {
+				t.Errorf("verifyMode(%q) = %q, want %q", tt.file.Path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileStats(t *testing.T) {
+	weights := bytes.Repeat([]byte("weights-0123456789"), 4000)
+	newFakeRepo(t, map[string][]byte{
+		"config.json":       []byte(`{"a": 1}`),
+		"model.safetensors": weights,
+		"model.onnx":        []byte("onnx"),
+	}, "model.safetensors", "model.onnx")
+	dir := t.TempDir()
+	if err := DownloadModel("o/r:safetensors", false, false, false, dir, "main", 4, "", true); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]FileStat{}
+	for _, stat := range FileStats() {
+		got[stat.Path] = stat
+	}
+	if stat := got["model.safetensors"]; stat.Skipped || !stat.Multipart || stat.Bytes != int64(len(weights)) || stat.HTTPStatus != http.StatusPartialContent || stat.Retries != 0 {
+		t.Errorf("multipart LFS file: %+v", stat)
+	}
+	if stat := got["config.json"]; stat.Skipped || stat.Multipart || stat.Bytes != 8 || stat.HTTPStatus != http.StatusOK {
+		t.Errorf("small file: %+v", stat)
+	}
+	if stat := got["model.onnx"]; !stat.Skipped || stat.SkipReason != "filtered" {
+		t.Errorf("filtered file: %+v", stat)
+	}
+
+	// a second run finds everything in place
+	if err := DownloadModel("o/r:safetensors", false, false, false, dir, "main", 4, "", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, stat := range FileStats() {
+		if !stat.Skipped || stat.Bytes != 0 {
+			t.Errorf("second run: %+v", stat)
+		}
+	}
+}
+
+// leaveParts writes the parts an interrupted multipart download of content in numParts parts leaves behind, cut to the given sizes
+func leaveParts(t *testing.T, tempFolder, baseFileName string, content []byte, numParts int, sizes ...int) {
+	t.Helper()
+	if err := os.MkdirAll(tempFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	chunkSize := len(content) / numParts
+	for i := 0; i < numParts; i++ {
+		part := append([]byte{}, content[i*chunkSize:]...)
+		for len(part) < sizes[i] {
+			part = append(part, 'x') // a part grown past the end of the file
+		}
+		part = part[:sizes[i]]
+		if err := os.WriteFile(partPath(tempFolder, baseFileName, i), part, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResumeCompletePartGets416(t *testing.T) {
+	content := bytes.Repeat([]byte("range-0123456789"), 1000)
+	repo := newFakeRepo(t, map[string][]byte{"model.bin": content})
+	var unsatisfiable int
+	repo.serve = func(w http.ResponseWriter, r *http.Request) bool {
+		var start int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err == nil && start >= len(content) {
+			unsatisfiable++
+		}
+		return false
+	}
+	NumConnections = 4
+	dir := t.TempDir()
+	tempFolder := filepath.Join(dir, "tmp")
+	chunkSize := len(content) / 4
+	// the last part grew past its range, asking for its missing bytes starts past the end of the file
+	leaveParts(t, tempFolder, "model.bin", content, 4, 10, 0, chunkSize/2, chunkSize+40)
+	out := filepath.Join(dir, "model.bin")
+	if err := downloadFileMultiThread(tempFolder, repo.URL+"/blob/model.bin", "", out, true); err != nil {
+		t.Fatal(err)
+	}
+	if unsatisfiable == 0 {
+		t.Error("the complete part was not requested past the end of the file")
+	}
+	got, _ := os.ReadFile(out)
+	if !bytes.Equal(got, content) {
+		t.Errorf("merged file differs, %d bytes instead of %d", len(got), len(content))
+	}
+}
+
+func TestTruncatedTreeIsRetried(t *testing.T) {
+	repo := newFakeRepo(t, map[string][]byte{"config.json": []byte("{}")})
+	var requests int
+	var body string
+	var everyTime bool // else only the first request gets body, the next ones the real tree
+	repo.serve = func(w http.ResponseWriter, r *http.Request) bool {
+		if !strings.HasPrefix(r.URL.Path, "/api/models/") {
+			return false
+		}
+		requests++
+		if requests > 1 && !everyTime {
+			return false
+		}
+		fmt.Fprint(w, body)
+		return true
+	}
+
+	// cut off mid-JSON, as by a proxy dropping the connection: requested again
+	body = `[{"type":"file","path":"config.json","si`
+	if err := DownloadModel("o/r", false, false, false, t.TempDir(), "main", 2, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("truncated tree requested %d times, want 2", requests)
+	}
+
+	// complete but malformed: retrying would get the same answer
+	requests, everyTime = 0, true
+	body = `[{"type":"file","path":"config.json"},]`
+	if err := DownloadModel("o/r", false, false, false, t.TempDir(), "main", 2, "", true); err == nil {
+		t.Error("malformed tree accepted")
+	}
+	if requests != 1 {
+		t.Errorf("malformed tree requested %d times, want 1", requests)
+	}
+
+	// no retries still makes the request once, and reports its failure
+	defer func(retries int) { ScanRetries = retries }(ScanRetries)
+	ScanRetries, requests = 0, 0
+	if err := DownloadModel("o/r", false, false, false, t.TempDir(), "main", 2, "", true); err == nil {
+		t.Error("ScanRetries 0 accepted the malformed tree")
+	}
+	if requests != 1 {
+		t.Errorf("with ScanRetries 0 the tree was requested %d times, want 1", requests)
+	}
+}
+
+// panicTransport sends requests to the test server, the body of the range request panicRange panics after some bytes
+type panicTransport struct {
+	panicRange string
+	mu         sync.Mutex
+	closed     int   // bodies of range requests closed
+	served     int64 // bytes read from range requests
+}
+
+func (pt *panicTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(r)
+	if err == nil && r.Header.Get("Range") != "" {
+		resp.Body = &panicBody{ReadCloser: resp.Body, pt: pt, panics: r.Header.Get("Range") == pt.panicRange}
+	}
+	return resp, err
+}
+
+func (pt *panicTransport) state() (closed int, served int64) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	return pt.closed, pt.served
+}
+
+type panicBody struct {
+	io.ReadCloser
+	pt     *panicTransport
+	panics bool
+	read   int
+}
+
+func (b *panicBody) Read(p []byte) (int, error) {
+	if b.panics && b.read >= 100 {
+		panic("reading the body")
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += n
+	b.pt.mu.Lock()
+	b.pt.served += int64(n)
+	b.pt.mu.Unlock()
+	return n, err
+}
+
+func (b *panicBody) Close() error {
+	b.pt.mu.Lock()
+	b.pt.closed++
+	b.pt.mu.Unlock()
+	return b.ReadCloser.Close()
+}
+
+func TestPanickingChunkKeepsOtherParts(t *testing.T) {
+	content := bytes.Repeat([]byte("panic-0123456789"), 1000)
+	repo := newFakeRepo(t, map[string][]byte{"model.bin": content})
+	chunkSize := len(content) / 4
+	pt := &panicTransport{panicRange: fmt.Sprintf("bytes=%d-%d", 2*chunkSize, 3*chunkSize-1)}
+	HTTPClient = &http.Client{Transport: pt}
+	NumConnections, NumSplits = 1, 4
+	defer func() { HTTPClient, NumConnections, NumSplits = nil, DefaultNumConnections, 0 }()
+	dir := t.TempDir()
+	tempFolder := filepath.Join(dir, "tmp")
+	out := filepath.Join(dir, "model.bin")
+
+	if err := downloadFileMultiThread(tempFolder, repo.URL+"/blob/model.bin", "", out, true); err == nil {
+		t.Fatal("a panicking chunk should fail the download")
+	}
+	// the other parts keep running after the error is returned, wait for them and for the panicking part to be emptied
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		closed, _ := pt.state()
+		fi, err := os.Stat(partPath(tempFolder, "model.bin", 2))
+		if closed == 4 && err == nil && fi.Size() == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("parts still running: %d bodies closed, part 2: %v", closed, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, i := range []int{0, 1, 3} {
+		if fi, err := os.Stat(partPath(tempFolder, "model.bin", i)); err != nil || fi.Size() != int64(chunkSize) {
+			t.Errorf("part %d lost: %v", i, err)
+		}
+	}
+
+	// the next run fetches the emptied part only
+	pt.panicRange = ""
+	_, before := pt.state()
+	if err := downloadFileMultiThread(tempFolder, repo.URL+"/blob/model.bin", "", out, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, after := pt.state(); after-before != int64(chunkSize) {
+		t.Errorf("resume downloaded %d bytes, want the %d of the emptied part", after-before, chunkSize)
+	}
+	got, _ := os.ReadFile(out)
+	if !bytes.Equal(got, content) {
+		t.Errorf("merged file differs, %d bytes instead of %d", len(got), len(content))
+	}
+}
+
+func TestResumeAfterRemoteChange(t *testing.T) {
+	old := bytes.Repeat([]byte("old-0123456789ab"), 1000)
+	updated := bytes.Repeat([]byte("new-0123456789ab"), 1000)
+	repo := newFakeRepo(t, map[string][]byte{"model.bin": old})
+	var changed bool
+	var ifRange int
+	repo.serve = func(w http.ResponseWriter, r *http.Request) bool {
+		// the repo is updated between the size probe and the part requests
+		if r.Header.Get("Range") != "" && !changed {
+			changed = true
+			repo.setFile("model.bin", updated)
+		}
+		if r.Header.Get("If-Range") != "" {
+			ifRange++
+		}
+		return false
+	}
+	NumConnections = 4
+	dir := t.TempDir()
+	tempFolder := filepath.Join(dir, "tmp")
+	out := filepath.Join(dir, "model.bin")
+	chunkSize := len(old) / 4
+	// only part 2 is unfinished, so it is the only one sending a request
+	leaveParts(t, tempFolder, "model.bin", old, 4, chunkSize, chunkSize, chunkSize/2, len(old)-3*chunkSize)
+	sum := sha256.Sum256(old)
+	if err := os.WriteFile(filepath.Join(tempFolder, "model.bin.etag"), []byte(`"`+hex.EncodeToString(sum[:8])+`"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// If-Range gets the whole new file instead of the rest of the part: the part is dropped rather than mixed
+	if err := downloadFileMultiThread(tempFolder, repo.URL+"/blob/model.bin", "", out, true); err == nil {
+		t.Fatal("a part resumed against a changed file should fail")
+	}
+	if ifRange != 1 {
+		t.Errorf("%d resumed parts sent If-Range, want 1", ifRange)
+	}
+	if _, err := os.Stat(partPath(tempFolder, "model.bin", 2)); !os.IsNotExist(err) {
+		t.Errorf("the resumed part was kept: %v", err)
+	}
+
+	// the next run sees the ETag differ from the one the parts were started with and starts over
+	if err := downloadFileMultiThread(tempFolder, repo.URL+"/blob/model.bin", "", out, true); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(out)
+	if !bytes.Equal(got, updated) {
+		t.Errorf("the download mixed old and new content")
+	}
+}
+
+func TestExpiredLinkIsRefreshed(t *testing.T) {
+	content := bytes.Repeat([]byte("signed-0123456789"), 2000)
+	repo := newFakeRepo(t, map[string][]byte{"model.bin": content}, "model.bin")
+	var mu sync.Mutex
+	var resolves, rejected int
+	repo.serve = func(w http.ResponseWriter, r *http.Request) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if p, ok := strings.CutPrefix(r.URL.Path, "/o/r/resolve/main/"); ok {
+			// each resolve signs a new link, only the first one expires
+			resolves++
+			http.Redirect(w, r, fmt.Sprintf("%s/blob/%s?sig=%d", repo.URL, p, resolves), http.StatusFound)
+			return true
+		}
+		if r.URL.Query().Get("sig") == "1" && r.Header.Get("Range") != "" {
+			rejected++
+			http.Error(w, "Request has expired", http.StatusForbidden)
+			return true
+		}
+		return false
+	}
+	check := func(name, dir string) {
+		t.Helper()
+		got, _ := os.ReadFile(filepath.Join(dir, "o_r", "model.bin"))
+		if !bytes.Equal(got, content) {
+			t.Errorf("%s: downloaded %d bytes, want %d", name, len(got), len(content))
+		}
+		if rejected == 0 || resolves != 2 {
+			t.Errorf("%s: %d requests rejected and %d resolves, want the expired link resolved once more", name, rejected, resolves)
+		}
+		for _, stat := range FileStats() {
+			if stat.Path == "model.bin" && stat.Retries == 0 {
+				t.Errorf("%s: the refreshed link is not counted as a retry", name)
+			}
+		}
+	}
+
+	// every part gets the 403, the link is refreshed once for all of them
+	dir := t.TempDir()
+	if err := DownloadModel("o/r", false, false, false, dir, "main", 4, "", true); err != nil {
+		t.Fatal(err)
+	}
+	check("multipart", dir)
+
+	// the rest of a partial file is asked for with the expired link, then with a fresh one
+	defer func(policy string) { OnExistingDifferentSize = policy }(OnExistingDifferentSize)
+	OnExistingDifferentSize = "resume"
+	resolves, rejected = 0, 0
+	dir = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "o_r"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "o_r", "model.bin"), content[:len(content)/3], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := DownloadModel("o/r", false, false, false, dir, "main", 4, "", true); err != nil {
+		t.Fatal(err)
+	}
+	check("resume", dir)
+}
+
+func TestCheckNameLengths(t *testing.T) {
+	dir, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	room := maxPathLength - len(dir) - 1 // characters left below dir
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{"short", "o_r/config.json", false},
+		{"longer than MAX_PATH", strings.Repeat("folder/", 50) + "config.json", false}, // Go opens long absolute paths on Windows with \\?\
+		{"name too long", "o_r/" + strings.Repeat("a", maxNameLength+1), true},
+		{"folder name too long", strings.Repeat("a", maxNameLength+1) + "/config.json", true},
+		{"path at the limit", strings.Repeat("a/", (room-1)/2) + "b", false},
+		{"path over the limit", strings.Repeat("a/", room/2) + "bb", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkNameLengths(tt.path); (err != nil) != tt.wantErr {
+				t.Errorf("checkNameLengths(%d characters) = %v, want error %t", len(tt.path), err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOutput(t *testing.T) {
+	newFakeRepo(t, map[string][]byte{"config.json": []byte(`{"a": 1}`)})
+	var buf bytes.Buffer
+	Output = &buf
+	defer func() { Output = os.Stdout }()
+	if err := DownloadModel("o/r", false, false, false, t.TempDir(), "main", 2, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "config.json") {
+		t.Errorf("the progress did not go to Output: %q", buf.String())
+	}
+}
+
+func TestMatchesFilter(t *testing.T) {
+	tests := []struct {
+		filters string // as in name:filters
+		path    string
+		want    bool
+	}{
+		{"*.gguf", "model.Q4_K_M.gguf", true},
+		{"*.gguf", "gguf/model.Q4_K_M.gguf", true},
+		{"*.gguf", "model.safetensors", false},
+		{"/Q[45]_K_M/", "model.Q4_K_M.gguf", true},
+		{"/Q[45]_K_M/", "sub/model.q5_k_m.gguf", true},
+		{"/Q[45]_K_M/", "model.Q6_K.gguf", false},
+		{"/Q[45]_K_M/", "model.Q4_K_S.gguf", false},
+		{"q4_0", "model.Q4_0.gguf", true}, // plain filters are case insensitive substrings
+		{"q4_0", "q4_0/model.Q8_0.gguf", false},
+		{"q4_0", "model.q4_0_4_4.gguf", true},
+		{"*.gguf,!/Q[45]_K_M/", "model.Q4_K_M.gguf", false}, // the last match wins
+		{"*.gguf,!/Q[45]_K_M/", "model.Q8_0.gguf", true},
+		{`/\Dq4_0/`, "model-Q4_0.gguf", true}, // \D is not lower cased into \d
+		{`/\Dq4_0/`, "model7q4_0.gguf", false},
+		{"/q{4,5}_0/", "model.qqqq_0.gguf", true}, // the comma belongs to the regex
+		{"/q{4,5}_0/,*.bin", "model.q4_0.gguf", false},
+		{"/q{4,5}_0/,*.bin", "model.bin", true},
+		{"/(?:q4|q5)_k_m/", "model.Q5_K_M.gguf", true}, // and so does the colon
+		{"/(?:q4|q5)_k_m/", "model.Q6_K.gguf", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filters+" "+tt.path, func(t *testing.T) {
+			if err := compileFilterRegexps("o/r:" + tt.filters); err != nil {
+				t.Fatal(err)
+			}
+			if got := matchesFilter(tt.path, splitFilters(tt.filters)); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+	if err := compileFilterRegexps("o/r:/q[4/"); err == nil {
+		t.Error("an invalid regex filter was accepted")
+	}
+
+	// the repo name ends at the first colon, a download keeps the rest of the filter whole
+	newFakeRepo(t, map[string][]byte{"model.Q4_K_M.gguf": []byte("q4"), "model.Q8_0.gguf": []byte("q8")}, "model.Q4_K_M.gguf", "model.Q8_0.gguf")
+	dir := t.TempDir()
+	if err := DownloadModel("o/r:/(?:q4|q5)_k_m/", false, false, false, dir, "main", 2, "", true); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"model.Q4_K_M.gguf": true, "model.Q8_0.gguf": false} {
+		if _, err := os.Stat(filepath.Join(dir, "o_r", name)); (err == nil) != want {
+			t.Errorf("%s downloaded %t, want %t", name, err == nil, want)
+		}
+	}
+}
+
+func TestFilterFolders(t *testing.T) {
+	newFakeRepo(t, map[string][]byte{
+		"config.json":       []byte(`{"a": 1}`),
+		"model.Q4_K_M.gguf": []byte("q4"),
+		"model.Q8_0.gguf":   []byte("q8"),
+	}, "model.Q4_K_M.gguf", "model.Q8_0.gguf")
+	dir := t.TempDir()
+	// -f: every filter gets a folder of its own, holding the configs too
+	if err := DownloadModel("o/r:q4_k_m,q8_0", true, false, false, dir, "main", 2, "", true); err != nil {
+		t.Fatal(err)
+	}
+	for _, folder := range []struct{ name, model, other string }{
+		{"o_r_f_q4_k_m", "model.Q4_K_M.gguf", "model.Q8_0.gguf"},
+		{"o_r_f_q8_0", "model.Q8_0.gguf", "model.Q4_K_M.gguf"},
+	} {
+		for name, want := range map[string]bool{"config.json": true, folder.model: true, folder.other: false} {
+			if _, err := os.Stat(filepath.Join(dir, folder.name, name)); (err == nil) != want {
+				t.Errorf("%s/%s downloaded %t, want %t", folder.name, name, err == nil, want)
+			}
+		}
+	}
+
+	// the manifest is at the root of the storage path, listing the files of every filter folder
+	defer func(write bool) { WriteManifest = write }(WriteManifest)
+	WriteManifest = true
+	if err := DownloadModel("o/r:q4_k_m,q8_0", true, false, false, dir, "main", 2, "", true); err != nil {
+		t.Fatal(err)
+	}
+	results, err := VerifyManifest(ManifestPath(dir, "o/r:q4_k_m,q8_0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var locals []string
+	for _, result := range results {
+		if result.Status != "OK" {
+			t.Errorf("%s: %s %s", result.Local, result.Status, result.Reason)
+		}
+		rel, _ := filepath.Rel(dir, result.Local)
+		locals = append(locals, filepath.ToSlash(rel))
+	}
+	sort.Strings(locals)
+	want := []string{"o_r_f_q4_k_m/config.json", "o_r_f_q4_k_m/model.Q4_K_M.gguf", "o_r_f_q8_0/config.json", "o_r_f_q8_0/model.Q8_0.gguf"}
+	if !reflect.DeepEqual(locals, want) {
+		t.Errorf("manifest lists %v, want %v", locals, want)
+	}
+}
+
+func TestCorruptLFSFile(t *testing.T) {
+	weights := bytes.Repeat([]byte("weights-0123456789"), 1000)
+	repo := newFakeRepo(t, map[string][]byte{"model.safetensors": weights}, "model.safetensors")
+	corrupt := bytes.ToUpper(weights) // same size, other hash
+	repo.serve = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/blob/model.safetensors" {
+			return false
+		}
+		http.ServeContent(w, r, "model.safetensors", time.Time{}, bytes.NewReader(corrupt))
+		return true
+	}
+	dir := t.TempDir()
+	local := filepath.Join(dir, "o_r", "model.safetensors")
+
+	// a download that does not match its hash is an error, and nothing is left behind to be taken for a good file
+	if err := DownloadModel("o/r", false, false, false, dir, "main", 4, "", true); err == nil {
+		t.Fatal("a corrupt download succeeded")
+	}
+	if _, err := os.Stat(local); !os.IsNotExist(err) {
+		t.Errorf("the corrupt file was kept: %v", err)
+	}
+
+	// a corrupt file already on disk is downloaded again
+	repo.serve = nil
+	if err := os.WriteFile(local, corrupt, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := DownloadModel("o/r", false, false, false, dir, "main", 4, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(local); !bytes.Equal(got, weights) {
+		t.Error("the corrupt local file was not downloaded again")
+	}
+}
+
+func TestWhoAmI(t *testing.T) {
+	repo := newFakeRepo(t, map[string][]byte{})
+	var status int
+	repo.serve = func(w http.ResponseWriter, r *http.Request) bool {
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return true
+		}
+		fmt.Fprint(w, `{"name": "someone"}`)
+		return true
+	}
+	tests := []struct {
+		status      int
+		wantName    string
+		wantInvalid bool
+	}{
+		{http.StatusOK, "someone", false},
+		{http.StatusUnauthorized, "", true},
+		{http.StatusNotFound, "", false}, // e.g. a mirror without the whoami API
+		{http.StatusInternalServerError, "", false},
+	}
+	for _, tt := range tests {
+		status = tt.status
+		name, err := WhoAmI("token")
+		if name != tt.wantName || errors.Is(err, ErrInvalidToken) != tt.wantInvalid || (err == nil) != (tt.status == http.StatusOK) {
+			t.Errorf("status %d: got %q, %v", tt.status, name, err)
+		}
+	}
+}
+
+func TestVerifyETag(t *testing.T) {
+	repo := newFakeRepo(t, map[string][]byte{"config.json": []byte(`{"a": 1}`)})
+	VerifyOverrides = []VerifyOverride{{"*.json", "etag"}}
+	defer func() { VerifyOverrides = nil }()
+	// the GET the file is downloaded with and the HEAD checking it afterwards get their own ETag, they differ when the file changed in between
+	var getETag, headETag string
+	repo.serve = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/o/r/raw/main/config.json" {
+			return false
+		}
+		w.Header().Set("ETag", getETag)
+		if r.Method == http.MethodHead {
+			w.Header().Set("ETag", headETag)
+		}
+		http.ServeContent(w, r, "config.json", time.Time{}, bytes.NewReader([]byte(`{"a": 1}`)))
+		return true
+	}
+	tests := []struct {
+		name              string
+		getETag, headETag string
+		wantErr           bool
+	}{
+		{"weak", `W/"v1"`, `W/"v1"`, false},
+		{"weak then strong", `W/"v1"`, `"v1"`, false},
+		{"changed", `W/"v1"`, `W/"v2"`, true},
+		{"none", "", `"v1"`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getETag, headETag = tt.getETag, tt.headETag
+			dir := t.TempDir()
+			err := DownloadModel("o/r", false, false, false, dir, "main", 2, "", true)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want error %t", err, tt.wantErr)
+			}
+			if _, statErr := os.Stat(filepath.Join(dir, "o_r", "config.json")); (statErr == nil) == tt.wantErr {
+				t.Errorf("file kept %t after %v", statErr == nil, err)
+			}
+		})
+	}
+}
+
+func TestDownloadSingleThreadedSize(t *testing.T) {
+	content := []byte(`{"a": 1}`)
+	repo := newFakeRepo(t, map[string][]byte{"config.json": content})
+	out := filepath.Join(t.TempDir(), "config.json")
+	tests := []struct {
+		name    string
+		body    []byte // served with a matching Content-Length
+		size    int64
+		wantErr string
+	}{
+		{"listed size", content, int64(len(content)), ""},
+		{"size unknown", content, -1, ""},
+		{"cut short", content[:4], int64(len(content)), "closed early"},
+		{"longer than listed", append(content, '\n'), int64(len(content)), "may have changed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo.setFile("config.json", tt.body)
+			err := downloadSingleThreaded(repo.URL+"/o/r/raw/main/config.json", out, tt.size)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("got %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// BenchmarkScanTree walks a repo of 3 levels of 5 folders, each tree request taking 2ms like a distant server,
+// listing the folders one by one against listing them ScanConcurrency at a time
+func BenchmarkScanTree(b *testing.B) {
+	files := map[string][]byte{}
+	for i := 0; i < 5; i++ {
+		for j := 0; j < 5; j++ {
+			for k := 0; k < 5; k++ {
+				files[fmt.Sprintf("d%d/d%d/d%d/data.txt", i, j, k)] = []byte("x")
+			}
+		}
+	}
+	repo := &fakeRepo{files: files, lfs: map[string]bool{}}
+	repo.serve = func(w http.ResponseWriter, r *http.Request) bool {
+		time.Sleep(2 * time.Millisecond)
+		return false
+	}
+	repo.Server = httptest.NewServer(http.HandlerFunc(repo.handle))
+	defer repo.Close()
+	Endpoint, Excludes, AllowEmpty = repo.URL, []string{"*.txt"}, true // every folder is listed, no file is downloaded
+	defer func() { Endpoint, Excludes, AllowEmpty, ScanConcurrency = DefaultEndpoint, nil, false, 0 }()
+
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency %d", concurrency), func(b *testing.B) {
+			ScanConcurrency = concurrency
+			dir := b.TempDir()
+			for i := 0; i < b.N; i++ {
+				if err := DownloadModel("o/r", false, false, false, dir, "main", 4, "", true); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestTreePagination(t *testing.T) {
+	files := map[string][]byte{}
+	for i := 0; i < 5; i++ {
+		files[fmt.Sprintf("data-%d.txt", i)] = []byte("x")
+	}
+	repo := newFakeRepo(t, files)
+	// the root folder comes in two pages, the second one behind a relative Link to a cursor
+	var pages []string
+	repo.serve = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/api/models/o/r/tree/main" && r.URL.Path != "/api/models/o/r/tree/main/" {
+			return false
+		}
+		pages = append(pages, r.URL.RawQuery)
+		list := repo.tree("")
+		if r.URL.Query().Get("cursor") == "" {
+			w.Header().Set("Link", `</api/models/o/r/tree/main?cursor=page2>; rel="next"`)
+			list = list[:3]
+		} else {
+			list = list[3:]
+		}
+		json.NewEncoder(w).Encode(list)
+		return true
+	}
+	listed, err := ListModel("o/r", false, "main", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, file := range listed {
+		got = append(got, file.Path)
+	}
+	sort.Strings(got)
+	if want := "data-0.txt data-1.txt data-2.txt data-3.txt data-4.txt"; strings.Join(got, " ") != want {
+		t.Errorf("listed %v, want %s", got, want)
+	}
+	if len(pages) != 2 || pages[1] != "cursor=page2" {
+		t.Errorf("pages requested: %q", pages)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	clock := time.Unix(0, 0)
+	now, sleep = func() time.Time { return clock }, func(d time.Duration) { clock = clock.Add(d) }
+	defer func() {
+		now, sleep, MaxBytesPerSec, MaxBytesPerSecPerConn, limiter = time.Now, time.Sleep, 0, 0, tokenBucket{}
+	}()
+	tests := []struct {
+		name        string
+		global      int64
+		perConn     int64
+		connections int
+		want        time.Duration // to read 6000 bytes, the buckets start full with a second of bytes
+	}{
+		{"per connection", 0, 1000, 1, 5 * time.Second},
+		{"global", 1000, 0, 1, 5 * time.Second},
+		{"global shared", 1000, 0, 3, 5 * time.Second},
+		{"per connection below global", 3000, 1000, 1, 5 * time.Second},
+		{"global below per connection", 1000, 3000, 1, 5 * time.Second},
+		{"per connection, each", 0, 1000, 3, 1 * time.Second},
+		{"global below the connections together", 1500, 1000, 3, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MaxBytesPerSec, MaxBytesPerSecPerConn, limiter = tt.global, tt.perConn, tokenBucket{}
+			start := clock
+			conns := make([]*connLimiter, tt.connections)
+			for i := range conns {
+				conns[i] = &connLimiter{}
+			}
+			// the connections take turns reading 100 bytes, a sleep of one lets time pass for all
+			for read := 0; read < 6000; read += 100 {
+				conns[read/100%len(conns)].wait(100)
+			}
+			if elapsed := clock.Sub(start); elapsed < tt.want-10*time.Millisecond || elapsed > tt.want+10*time.Millisecond {
+				t.Errorf("6000 bytes read in %v, want %v", elapsed, tt.want)
+			}
+		})
+	}
+}
+
+// countingTransport counts the requests it sends to the test server
+type countingTransport struct {
+	mu       sync.Mutex
+	requests int
+}
+
+func (ct *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	ct.mu.Lock()
+	ct.requests++
+	ct.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestHTTPClientNotChanged(t *testing.T) {
+	newFakeRepo(t, map[string][]byte{
+		"config.json":       []byte(`{"a": 1}`),
+		"model.safetensors": bytes.Repeat([]byte("weights-0123456789"), 1000),
+	}, "model.safetensors")
+	transport := &countingTransport{}
+	HTTPClient = &http.Client{Transport: transport, Timeout: 7 * time.Second}
+	defer func() { HTTPClient = nil }()
+	// the LFS file goes through the resolve redirect, which is followed by hand
+	if err := DownloadModel("o/r", false, false, false, t.TempDir(), "main", 4, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if transport.requests == 0 {
+		t.Error("the injected client was not used")
+	}
+	if HTTPClient.CheckRedirect != nil || HTTPClient.Timeout != 7*time.Second {
+		t.Errorf("the injected client was changed: CheckRedirect set %t, Timeout %v", HTTPClient.CheckRedirect != nil, HTTPClient.Timeout)
+	}
+}
+
+// BenchmarkHashing downloads and checks a 16MiB file, hashing it while it is written against reading it again once written,
+// over loopback and over a link capped at 64MiB/s, where hashing while receiving hides the hash in the wait for the network
+func BenchmarkHashing(b *testing.B) {
+	content := bytes.Repeat([]byte("weights-0123456789abcdef"), 16<<20/24)
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+	repo := &fakeRepo{files: map[string][]byte{"model.bin": content}, lfs: map[string]bool{}}
+	repo.Server = httptest.NewServer(http.HandlerFunc(repo.handle))
+	defer repo.Close()
+	url := repo.URL + "/blob/model.bin"
+	out := filepath.Join(b.TempDir(), "model.bin")
+	defer func() { MaxBytesPerSec, limiter = 0, tokenBucket{} }()
+
+	for _, link := range []struct {
+		name string
+		rate int64
+	}{{"loopback", 0}, {"64MiB/s", 64 << 20}} {
+		MaxBytesPerSec = link.rate
+		b.Run(link.name+"/streamed", func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				limiter = tokenBucket{last: time.Now()} // empty, no burst
+				if err := downloadSingleThreaded(url, out, int64(len(content))); err != nil {
+					b.Fatal(err)
+				}
+				if err := verifyChecksum(out, checksum); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(link.name+"/re-read", func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				// a resume from the start writes the same bytes without hashing them, verifyChecksum then reads the file again
+				if err := os.WriteFile(out, nil, 0644); err != nil {
+					b.Fatal(err)
+				}
+				limiter = tokenBucket{last: time.Now()}
+				if err := resumeSingleThreaded(url, out, 0, int64(len(content))); err != nil {
+					b.Fatal(err)
+				}
+				if err := verifyChecksum(out, checksum); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
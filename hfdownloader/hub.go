@@ -0,0 +1,137 @@
+package hfdownloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	JsonModelRevisionURL   = "https://huggingface.co/api/models/%s/revision/%s"
+	JsonDatasetRevisionURL = "https://huggingface.co/api/datasets/%s/revision/%s"
+)
+
+var hubSnapshot string // snapshots/<commit> folder of the current DownloadModel call with the hub layout
+
+// hubRepoFolder is the folder of a repo in the hub cache, models--owner--name or datasets--owner--name
+func hubRepoFolder(repo string, IsDataset bool) string {
+	kind := "models"
+	if IsDataset {
+		kind = "datasets"
+	}
+	return kind + "--" + strings.ReplaceAll(repo, "/", "--")
+}
+
+// prepareHubSnapshot resolves the branch to its commit, writes it to refs/<branch> and sets hubSnapshot, like huggingface_hub does
+func prepareHubSnapshot(modelPath, repo string, IsDataset bool, branch string) error {
+	revisionURL := EndpointURL(JsonModelRevisionURL)
+	if IsDataset {
+		revisionURL = EndpointURL(JsonDatasetRevisionURL)
+	}
+	client, err := NewHTTPClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", fmt.Sprintf(revisionURL, repo, url.PathEscape(branch)), nil)
+	if err != nil {
+		return err
+	}
+	if RequiresAuth {
+		req.Header.Add("Authorization", "Bearer "+AuthToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	var revision struct {
+		Sha string `json:"sha"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&revision); err != nil {
+		return err
+	}
+	if revision.Sha == "" {
+		return fmt.Errorf("no commit found for revision %q of %s", branch, repo)
+	}
+
+	for _, dir := range []string{"blobs", "refs", "snapshots"} {
+		if err := os.MkdirAll(path.Join(modelPath, dir), os.ModePerm); err != nil {
+			return err
+		}
+	}
+	if branch != revision.Sha {
+		ref := filepath.Join(modelPath, "refs", filepath.FromSlash(branch))
+		if err := os.MkdirAll(filepath.Dir(ref), os.ModePerm); err != nil {
+			return err
+		}
+		if err := os.WriteFile(ref, []byte(revision.Sha), 0644); err != nil {
+			return err
+		}
+	}
+	hubSnapshot = path.Join(modelPath, "snapshots", revision.Sha)
+	return nil
+}
+
+// hubBlobPath is where the content of a file is stored in the hub layout, named after its sha256 for LFS files, its git oid otherwise
+func hubBlobPath(modelPath string, file hfmodel) string {
+	if file.Lfs != nil {
+		return path.Join(modelPath, "blobs", file.Lfs.Oid_SHA265)
+	}
+	return path.Join(modelPath, "blobs", file.Oid)
+}
+
+// localPath is the path a file is used from: its snapshot link in the hub layout, where it was downloaded otherwise
+func localPath(file hfmodel) string {
+	if Layout == "hub" {
+		return path.Join(hubSnapshot, file.Path)
+	}
+	return file.AppendedPath
+}
+
+// linkSnapshot points snapshots/<commit>/<repo path> to the blob of the file with a relative symlink,
+// on Windows, where symlinks need extra privileges, or when the link fails the blob is copied instead
+func linkSnapshot(file hfmodel) error {
+	if Layout != "hub" {
+		return nil
+	}
+	link := filepath.FromSlash(localPath(file))
+	if err := os.MkdirAll(filepath.Dir(link), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if runtime.GOOS != "windows" {
+		target, err := filepath.Rel(filepath.Dir(link), filepath.FromSlash(file.AppendedPath))
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(target, link); err == nil {
+			return nil
+		}
+	}
+	src, err := os.Open(file.AppendedPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(link)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
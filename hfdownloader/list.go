@@ -0,0 +1,15 @@
+package hfdownloader
+
+// ListModel returns the files a download of the repo would select, in tree order, without downloading anything,
+// the filters of ModelDatasetName, Files, Includes, Excludes and MaxDepth apply as they would for DownloadModel.
+// Destination is left empty, it depends on the storage path and layout
+func ListModel(ModelDatasetName string, IsDataset bool, ModelBranch string, token string, silentMode bool) ([]RepoFile, error) {
+	var files []RepoFile
+	err := walkSelectedFiles(ModelDatasetName, IsDataset, ModelBranch, token, silentMode, func(file hfmodel) {
+		files = append(files, RepoFile{Path: file.Path, Size: int64(file.Size), IsLFS: file.IsLFS})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
@@ -0,0 +1,115 @@
+package hfdownloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ManifestFileName ends the name of the manifest DownloadModel writes with WriteManifest, see ManifestPath
+const ManifestFileName = ".hfdownloader-manifest.json"
+
+var (
+	// WriteManifest writes ManifestFileName once a download succeeds, listing every file with its sha256, so the copy can be verified offline
+	WriteManifest = false
+	manifest      []ManifestEntry
+)
+
+// Manifest describes a downloaded repo, see WriteManifest
+type Manifest struct {
+	Repo   string          `json:"repo"`
+	Branch string          `json:"branch"`
+	Files  []ManifestEntry `json:"files"`
+}
+
+// ManifestEntry is one file of a Manifest, Local is relative to the manifest folder, the storage path
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Local  string `json:"local"`
+	Size   int64  `json:"size"`
+	LFS    bool   `json:"lfs"`
+	SHA256 string `json:"sha256"`
+}
+
+// addManifestEntry records a file for the manifest, verified tells whether its LFS sha256 was checked in this run,
+// other files are hashed now
+func addManifestEntry(file hfmodel, verified bool) error {
+	if !WriteManifest {
+		return nil
+	}
+	entry := ManifestEntry{Path: file.Path, Local: file.AppendedPath, Size: int64(file.Size), LFS: file.IsLFS}
+	if file.IsLFS && verified {
+		entry.SHA256 = file.Lfs.Oid_SHA265
+	} else {
+		sum, err := hashFile(file.AppendedPath, true)
+		if err != nil {
+			return err
+		}
+		entry.SHA256 = sum
+	}
+	manifest = append(manifest, entry)
+	return nil
+}
+
+// ManifestPath is where the manifest of a repo is written in the storage path: at its root, since -f and the layouts
+// spread the files of a repo over several folders
+func ManifestPath(storage, repo string) string {
+	repo, _, _ = strings.Cut(repo, ":")
+	return filepath.Join(storage, strings.Replace(repo, "/", "_", -1)+ManifestFileName)
+}
+
+// writeManifest writes the entries recorded by this run to target, through a temporary file so a crash never leaves half a manifest
+func writeManifest(target, repo, branch string) error {
+	folder := filepath.Dir(target)
+	m := Manifest{Repo: repo, Branch: branch, Files: []ManifestEntry{}}
+	for _, entry := range manifest {
+		if rel, err := filepath.Rel(folder, entry.Local); err == nil {
+			entry.Local = filepath.ToSlash(rel)
+		}
+		m.Files = append(m.Files, entry)
+	}
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(folder, os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.WriteFile(target+".tmp", content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(target+".tmp", target)
+}
+
+// VerifyManifest checks the files listed in a manifest, size and sha256, without any network call
+func VerifyManifest(manifestPath string) ([]VerifyResult, error) {
+	content, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(content, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %v", manifestPath, err)
+	}
+	results := make([]VerifyResult, 0, len(m.Files))
+	for _, entry := range m.Files {
+		local := filepath.FromSlash(entry.Local)
+		if !filepath.IsAbs(local) {
+			local = filepath.Join(filepath.Dir(manifestPath), local)
+		}
+		result := VerifyResult{Path: entry.Path, Local: local, Status: "OK"}
+		if info, err := os.Stat(local); err != nil {
+			result.Status, result.Reason = "MISSING", "not on disk"
+		} else if info.Size() != entry.Size {
+			result.Status, result.Reason = "CORRUPT", fmt.Sprintf("size %d, expected %d", info.Size(), entry.Size)
+		} else if sum, err := hashFile(local, true); err != nil {
+			result.Status, result.Reason = "CORRUPT", err.Error()
+		} else if sum != entry.SHA256 {
+			result.Status, result.Reason = "CORRUPT", "sha256 mismatch"
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
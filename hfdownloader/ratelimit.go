@@ -0,0 +1,88 @@
+package hfdownloader
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	// MaxBytesPerSec caps the total download speed, shared by all the files and parts downloading at once, 0 means unlimited
+	MaxBytesPerSec int64
+	// MaxBytesPerSecPerConn caps the speed of each connection on its own, on top of MaxBytesPerSec, 0 means unlimited.
+	// A connection waits for both, so whichever is the more restrictive at the time applies
+	MaxBytesPerSecPerConn int64
+
+	limiterMu sync.Mutex
+	limiter   tokenBucket
+
+	// now and sleep are the clock of the limits, replaced in tests
+	now   = time.Now
+	sleep = time.Sleep
+)
+
+// tokenBucket holds at most one second of bytes, so an idle connection can't burst above the cap for long
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes n bytes from the bucket refilled at rate bytes per second, and returns how long to sleep to pay the debt back
+func (b *tokenBucket) take(n int, rate float64) time.Duration {
+	now := now()
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	}
+	if b.tokens > rate {
+		b.tokens = rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// waitForBandwidth takes n bytes from the shared token bucket, sleeping while it is in debt
+func waitForBandwidth(n int) {
+	rate := float64(MaxBytesPerSec)
+	if rate <= 0 || n <= 0 {
+		return
+	}
+	limiterMu.Lock()
+	wait := limiter.take(n, rate)
+	limiterMu.Unlock()
+	if wait > 0 {
+		sleep(wait)
+	}
+}
+
+// connLimiter applies MaxBytesPerSecPerConn to one connection, each part download owns one
+type connLimiter struct {
+	bucket tokenBucket
+}
+
+// wait takes n bytes from the connection bucket first and then from the shared one
+func (c *connLimiter) wait(n int) {
+	if rate := float64(MaxBytesPerSecPerConn); rate > 0 && n > 0 {
+		if wait := c.bucket.take(n, rate); wait > 0 {
+			sleep(wait)
+		}
+	}
+	waitForBandwidth(n)
+}
+
+// rateLimitedReader applies MaxBytesPerSec and MaxBytesPerSecPerConn to every read of the wrapped reader, which is one connection
+type rateLimitedReader struct {
+	r       io.Reader
+	limiter *connLimiter
+}
+
+func (l rateLimitedReader) Read(p []byte) (int, error) {
+	if (MaxBytesPerSec > 0 || MaxBytesPerSecPerConn > 0) && len(p) > 32768 {
+		p = p[:32768] // small reads keep the speed smooth, instead of long sleeps after big bursts
+	}
+	n, err := l.r.Read(p)
+	l.limiter.wait(n)
+	return n, err
+}
@@ -0,0 +1,57 @@
+package hfdownloader
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadToken returns the first token found in: AuthToken, HF_TOKEN, HUGGING_FACE_HUB_TOKEN, then the token files written by huggingface-cli login,
+// that is HF_TOKEN_PATH or HF_HOME/token (default ~/.cache/huggingface/token) and the older ~/.huggingface/token.
+// An empty token with no error means none is set, a file that exists but can't be read is an error
+func LoadToken() (string, error) {
+	if AuthToken != "" {
+		return AuthToken, nil
+	}
+	for _, name := range []string{"HF_TOKEN", "HUGGING_FACE_HUB_TOKEN"} {
+		if token := strings.TrimSpace(os.Getenv(name)); token != "" {
+			return token, nil
+		}
+	}
+	for _, file := range tokenFiles() {
+		content, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if token := strings.TrimSpace(string(content)); token != "" {
+			return token, nil
+		}
+	}
+	return "", nil
+}
+
+// tokenFiles lists the token files huggingface_hub reads and writes, in the order they are checked
+func tokenFiles() []string {
+	if file := os.Getenv("HF_TOKEN_PATH"); file != "" {
+		return []string{file}
+	}
+	home, err := os.UserHomeDir()
+	hfHome := os.Getenv("HF_HOME")
+	if hfHome == "" {
+		if err != nil {
+			return nil
+		}
+		hfHome = filepath.Join(home, ".cache", "huggingface")
+		if cache := os.Getenv("XDG_CACHE_HOME"); cache != "" {
+			hfHome = filepath.Join(cache, "huggingface")
+		}
+	}
+	files := []string{filepath.Join(hfHome, "token")}
+	if err == nil {
+		files = append(files, filepath.Join(home, ".huggingface", "token"))
+	}
+	return files
+}
@@ -0,0 +1,162 @@
+package hfdownloader
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// VerifyResult is the state of one repo file on disk, as reported by VerifyModel
+type VerifyResult struct {
+	Path   string `json:"path"` // path inside the repo
+	Local  string `json:"local"`
+	Status string `json:"status"` // "OK", "MISSING" or "CORRUPT"
+	Reason string `json:"reason,omitempty"`
+}
+
+// VerifyModel checks the local copy of a repo against its file list, without downloading anything.
+// Every file selected by the filters is size checked, and hashed too unless SkipSHA: sha256 for LFS files, the git blob oid for the others.
+// Only the default layout is known, folders created by -f or the filter-flat layout are not checked
+func VerifyModel(ModelDatasetName string, SkipSHA bool, IsDataset bool, DestinationBasePath string, ModelBranch string, token string, silentMode bool) ([]VerifyResult, error) {
+	if absPath, err := filepath.Abs(DestinationBasePath); err == nil {
+		DestinationBasePath = absPath
+	}
+	storageRoot = DestinationBasePath
+	modelPath := path.Join(DestinationBasePath, strings.Replace(strings.Split(ModelDatasetName, ":")[0], "/", "_", -1))
+
+	var results []VerifyResult
+	err := walkSelectedFiles(ModelDatasetName, IsDataset, ModelBranch, token, silentMode, func(file hfmodel) {
+		local := path.Join(modelPath, file.Path)
+		if dst := routeDestination(file.Path); dst != "" {
+			local = dst
+		}
+		result := verifyLocalFile(file, local, SkipSHA)
+		if !silentMode && result.Status != "OK" {
+			fmt.Fprintf(Output, "\n%s", warningColor(result.Status, ": ", file.Path, ", ", result.Reason))
+		}
+		results = append(results, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// walkSelectedFiles lists the repo tree and calls fn for every file a download would select: filters, Files, Includes, Excludes and MaxDepth apply
+func walkSelectedFiles(ModelDatasetName string, IsDataset bool, ModelBranch string, token string, silentMode bool, fn func(file hfmodel)) error {
+	if err := compileFilterRegexps(ModelDatasetName); err != nil {
+		return err
+	}
+	modelP, filters, HasFilter := strings.Cut(ModelDatasetName, ":")
+	if IsDataset {
+		HasFilter = false // like downloads, datasets are never filtered
+	}
+	var FilterBinFileString []string
+	if HasFilter {
+		FilterBinFileString = splitFilters(filters)
+	}
+	if token != "" {
+		RequiresAuth = true
+		AuthToken = token
+	}
+	filesFound = map[string]bool{}
+
+	JsonTreeVariable := EndpointURL(JsonModelsFileTreeURL)
+	AgreementURL := fmt.Sprintf(EndpointURL(AgreementModelURL), modelP)
+	if IsDataset {
+		JsonTreeVariable = EndpointURL(JsonDatasetFileTreeURL)
+		AgreementURL = fmt.Sprintf(EndpointURL(AgreementDatasetURL), modelP)
+	}
+
+	var walk func(folderName string) error
+	walk = func(folderName string) error {
+		files, err := fetchFileList(fmt.Sprintf(JsonTreeVariable, modelP, ModelBranch, folderName), AgreementURL, silentMode)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if file.Type == "directory" {
+				if (len(Files) > 0 || len(Includes) > 0) && !wantedFolder(file.Path) {
+					continue
+				}
+				if MaxDepth > 0 && strings.Count(file.Path, "/")+1 > MaxDepth {
+					continue
+				}
+				if err := walk(file.Path); err != nil {
+					return err
+				}
+				continue
+			}
+			file.IsLFS = file.Lfs != nil
+			filterSkip := HasFilter && (file.IsLFS || StrictFilters) && !matchesFilter(file.Path, FilterBinFileString)
+			if allowlistSkip(file.Path, filterSkip) || excluded(file.Path) {
+				continue
+			}
+			fn(file)
+		}
+		return nil
+	}
+	return walk(filesRoot())
+}
+
+// verifyLocalFile checks a single file against its repo entry, the hash is only computed when the size matches
+func verifyLocalFile(file hfmodel, local string, SkipSHA bool) VerifyResult {
+	result := VerifyResult{Path: file.Path, Local: local, Status: "OK"}
+	info, err := os.Stat(local)
+	if err != nil {
+		result.Status, result.Reason = "MISSING", "not on disk"
+		if !os.IsNotExist(err) {
+			result.Reason = err.Error()
+		}
+		return result
+	}
+	if info.Size() != int64(file.Size) {
+		result.Status, result.Reason = "CORRUPT", fmt.Sprintf("size %d, expected %d", info.Size(), file.Size)
+		return result
+	}
+	// unlike downloads, non-LFS files are hashed too by default, VerifyOverrides still apply
+	probe := file
+	probe.IsLFS = true
+	if verifyMode(probe, SkipSHA) != "sha256" {
+		return result
+	}
+	kind, expected := "git oid", file.Oid
+	if file.IsLFS {
+		kind, expected = "sha256", file.Lfs.Oid_SHA265
+	}
+	actual, err := hashFile(local, file.IsLFS)
+	if err != nil {
+		result.Status, result.Reason = "CORRUPT", err.Error()
+	} else if actual != expected {
+		result.Status, result.Reason = "CORRUPT", kind+" mismatch"
+	}
+	return result
+}
+
+// hashFile returns the sha256 of an LFS file, or the git blob oid of any other file
+func hashFile(filePath string, lfs bool) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	hasher := sha256.New()
+	if !lfs {
+		hasher = sha1.New()
+		fmt.Fprintf(hasher, "blob %d\x00", info.Size())
+	}
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
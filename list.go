@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	hfd "github.com/bodaay/HuggingFaceModelDownloader/hfdownloader"
+)
+
+// runList prints the files a download of the repo would select as an indented tree, with sizes, LFS markers and totals, or as JSON
+func runList(config *Config, repo string, isDataset bool, asJSON bool) error {
+	token := config.AuthToken
+	if token == "" {
+		var err error
+		if token, err = loadToken(os.Stderr); err != nil {
+			return err
+		}
+	}
+
+	hfd.StrictFilters = config.StrictFilters
+	hfd.MatchFullPath = config.MatchFullPath
+	hfd.Files = config.Files
+	hfd.Includes = config.Includes
+	hfd.Excludes = config.Excludes
+	hfd.MaxDepth = config.MaxDepth
+	hfd.ScanRetries = scanRetries(config)
+	if !isDataset {
+		var err error
+		if isDataset, err = hfd.DetectDataset(repo, config.Branch, token); err != nil {
+			return err
+		}
+	}
+	files, err := hfd.ListModel(repo, isDataset, config.Branch, token, true)
+	if err != nil {
+		return err
+	}
+
+	// by path, the files of a folder come together
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+
+	if asJSON {
+		if files == nil {
+			files = []hfd.RepoFile{} // [] rather than null for an empty selection
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(files)
+	}
+
+	// a folder line is printed the first time a file below it shows up
+	var total, lfsTotal int64
+	lfsCount := 0
+	printed := map[string]bool{}
+	for _, f := range files {
+		parts := strings.Split(f.Path, "/")
+		for depth := 1; depth < len(parts); depth++ {
+			folder := strings.Join(parts[:depth], "/")
+			if !printed[folder] {
+				printed[folder] = true
+				fmt.Printf("%s%s/\n", strings.Repeat("  ", depth-1), parts[depth-1])
+			}
+		}
+		marker := ""
+		if f.IsLFS {
+			marker = "  LFS"
+			lfsCount++
+			lfsTotal += f.Size
+		}
+		name := strings.Repeat("  ", len(parts)-1) + parts[len(parts)-1]
+		fmt.Printf("%-60s %10s%s\n", name, formatSize(f.Size), marker)
+		total += f.Size
+	}
+	fmt.Printf("\n%d files, %s total, %d LFS files (%s)\n", len(files), formatSize(total), lfsCount, formatSize(lfsTotal))
+	return nil
+}
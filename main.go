@@ -1,16 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/user"
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	hfd "github.com/bodaay/HuggingFaceModelDownloader/hfdownloader"
@@ -22,6 +27,10 @@ const VERSION = "1.4.1"
 
 type Config struct {
 	NumConnections     int    `json:"num_connections"`
+	NumSplits          int    `json:"num_splits"`
+	RampUp             bool   `json:"ramp_up"`
+	MaxConnsPerHost    int    `json:"max_conns_per_host"`
+	ProbeRanges        bool   `json:"probe_ranges"`
 	RequiresAuth       bool   `json:"requires_auth"`
 	AuthToken          string `json:"auth_token"`
 	ModelName          string `json:"model_name"`
@@ -30,22 +39,71 @@ type Config struct {
 	Storage            string `json:"storage"`
 	OneFolderPerFilter bool   `json:"one_folder_per_filter"`
 	SkipSHA            bool   `json:"skip_sha"`
+	StrictFilters      bool   `json:"strict_filters"`
+	SplitSets          bool   `json:"split_sets"`
+	Layout             string `json:"layout"`
+	MaxDepth           int    `json:"max_depth"`
 	// Install            bool   `json:"install"`
 	// InstallPath        string `json:"install_path"`
-	MaxRetries    int  `json:"max_retries"`
-	RetryInterval int  `json:"retry_interval"`
-	JustDownload  bool `json:"just_download"`
-	SilentMode    bool `json:"silent_mode"`
+	MaxRetries       int    `json:"max_retries"`
+	RetryInterval    int    `json:"retry_interval"`
+	ScanRetries      int    `json:"scan_retries"`     // 0 means use MaxRetries
+	ScanConcurrency  int    `json:"scan_concurrency"` // 0 means use NumConnections
+	MaxTotalRetries  int    `json:"max_total_retries"`
+	JustDownload     bool   `json:"just_download"`
+	SilentMode       bool   `json:"silent_mode"`
+	Progress         string `json:"progress"` // "bar", or "none" to print nothing at all
+	ShowPartProgress bool   `json:"show_part_progress"`
+	ValidateToken    bool   `json:"validate_token"`
+	Prune            bool   `json:"prune"`
+	MinFreeSpace     string `json:"min_free_space"`
+	MaxRate          string `json:"max_rate"` // total download speed cap, e.g. "5MiB" per second, empty is unlimited
+	StopWhenFull     bool   `json:"stop_when_full"`
+	AllowEmpty       bool   `json:"allow_empty"`
+	WriteManifest    bool   `json:"write_manifest"`
+	CACertFile       string `json:"ca_cert_file"`
+	Insecure         bool   `json:"insecure"`
+	// OnExistingDifferentSize is one of "redownload", "resume", "skip" or "error"
+	OnExistingDifferentSize string `json:"on_existing_different_size"`
+	// VerifyExisting is "lfs", "all" or "off", how existing files are checked before being skipped, OnlyMissing forces "off"
+	VerifyExisting string `json:"verify_existing"`
+	OnlyMissing    bool   `json:"only_missing"`
+	// PrintPaths prints the local paths once done: "downloaded", "all" (up to date files too) or "json", empty prints nothing
+	PrintPaths string `json:"print_paths"`
+	// RouteRules send the files matching a glob to their own folder, --route adds to them
+	RouteRules []hfd.RouteRule `json:"route_rules"`
+	// PartDirs are folders, e.g. on different disks, the parts of multipart downloads are spread over
+	PartDirs []string `json:"part_dirs"`
+	// InsecureHosts are the host names TLS certificate verification is skipped for
+	InsecureHosts []string `json:"insecure_hosts"`
+	// Endpoint is the Hugging Face host or mirror to use, empty uses HF_ENDPOINT, then https://huggingface.co
+	Endpoint string `json:"endpoint"`
+	// MatchFullPath matches the filters without a "/" against the whole repo path, not only the file name
+	MatchFullPath bool `json:"match_full_path"`
+	// Files are exact repo paths to download, the filters are ignored
+	Files []string `json:"files"`
+	// Includes are globs on the repo path, only the matching files are downloaded, on top of Files
+	Includes []string `json:"includes"`
+	// VerifyOverrides force a verification mode, "sha256", "size" or "etag", on the files matching a glob, the first match wins
+	VerifyOverrides verifyOverridesFlag `json:"verify_overrides"`
+	// MaxRatePerConn caps the speed of each connection, e.g. "1MiB" per second, on top of MaxRate, empty is unlimited
+	MaxRatePerConn string `json:"max_rate_per_conn"`
+	// Excludes are filter patterns of files never downloaded, applied before the filters
+	Excludes []string `json:"excludes"`
 }
 
 // DefaultConfig returns a config instance populated with default values.
 func DefaultConfig() Config {
 	return Config{
-		NumConnections: 5,
-		Branch:         "main",
-		Storage:        "./",
-		MaxRetries:     3,
-		RetryInterval:  5,
+		NumConnections:          hfd.DefaultNumConnections,
+		Branch:                  "main",
+		Storage:                 "./",
+		MaxRetries:              3,
+		RetryInterval:           5,
+		ValidateToken:           true,
+		Progress:                "bar",
+		OnExistingDifferentSize: hfd.DefaultOnExistingDifferentSize,
+		VerifyExisting:          hfd.DefaultVerifyExisting,
 	}
 }
 
@@ -106,6 +164,8 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 	var justDownload bool
+	var pruneDryRun bool
+	var routes []string
 	var (
 		install     bool
 		installPath string
@@ -129,11 +189,46 @@ func main() {
 			}
 			return nil
 		},
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			// for every command, before the token, HF_ENDPOINT and TLS settings are read
+			_ = godotenv.Load() // Load .env file if exists
+			return nil
+		},
 		RunE: func(cmd *cobra.Command, args []string) error {
+			out := io.Writer(os.Stdout)
+			switch config.Progress {
+			case "bar":
+			case "none":
+				// nothing at all is printed, only the returned error matters
+				out = io.Discard
+				config.SilentMode = true
+			default:
+				return fmt.Errorf("unknown progress mode %q, use one of: bar, none", config.Progress)
+			}
+			// the paths are the only thing on stdout, everything else goes to stderr
+			pathsOut := io.Writer(os.Stdout)
+			switch config.PrintPaths {
+			case "":
+			case "downloaded", "all", "json":
+				if out != io.Discard {
+					out = os.Stderr
+				}
+			default:
+				return fmt.Errorf("unknown print paths mode %q, use one of: downloaded, all, json", config.PrintPaths)
+			}
+			hfd.Output = out
+			applyTLSSettings(config)
 			if justDownload {
 				config.ModelName = args[0] // Use the first argument as the model name
 				config.Storage = "./"
 			}
+			config.Storage, err = expandPath(config.Storage)
+			if err != nil {
+				return err
+			}
+			for _, name := range []*string{&config.ModelName, &config.DatasetName} {
+				*name = applyRevision(*name, config, cmd.Flags().Changed("branch"))
+			}
 			// Validate the ModelName parameter
 			// if !hfdn.IsValidModelName(modelName) { Just realized there are indeed models that don't follow this format :)
 			// 	// fmt.Println("Error:", err)
@@ -141,12 +236,8 @@ func main() {
 			// }
 			// Dynamic configuration updates (e.g., for AuthToken)
 			if config.AuthToken == "" {
-				config.AuthToken = os.Getenv("HF_TOKEN")
-				if config.AuthToken == "" {
-					config.AuthToken = os.Getenv("HUGGING_FACE_HUB_TOKEN")
-					if config.AuthToken != "" {
-						fmt.Println("DeprecationWarning: The environment variable 'HUGGING_FACE_HUB_TOKEN' is deprecated and will be removed in a future version. Please use 'HF_TOKEN' instead.")
-					}
+				if config.AuthToken, err = loadToken(out); err != nil {
+					return err
 				}
 			}
 			if install {
@@ -158,10 +249,18 @@ func main() {
 			var IsDataset bool
 			ModelOrDataSet := config.ModelName
 			if config.ModelName != "" {
-				fmt.Println("Model:", config.ModelName)
-				IsDataset = false
+				// the repo type is detected automatically, so a dataset passed with -m still works
+				IsDataset, err = hfd.DetectDataset(config.ModelName, config.Branch, config.AuthToken)
+				if err != nil {
+					return err
+				}
+				if IsDataset {
+					fmt.Fprintln(out, "Dataset (detected):", config.ModelName)
+				} else {
+					fmt.Fprintln(out, "Model:", config.ModelName)
+				}
 			} else if config.DatasetName != "" {
-				fmt.Println("Dataset:", config.DatasetName)
+				fmt.Fprintln(out, "Dataset:", config.DatasetName)
 				IsDataset = true
 				ModelOrDataSet = config.DatasetName
 			} else {
@@ -169,29 +268,120 @@ func main() {
 				return fmt.Errorf("Error: You must set either modelName or datasetName.")
 			}
 
-			_ = godotenv.Load() // Load .env file if exists
-
-			if config.AuthToken == "" {
-				config.AuthToken = os.Getenv("HF_TOKEN")
-				if config.AuthToken == "" {
-					config.AuthToken = os.Getenv("HUGGING_FACE_HUB_TOKEN")
-					if config.AuthToken != "" {
-						fmt.Println("DeprecationWarning: The environment variable 'HUGGING_FACE_HUB_TOKEN' is deprecated and will be removed in a future version. Please use 'HF_TOKEN' instead.")
-					}
+			// fail fast on a bad token, instead of a 401 mid-scan that looks like a gated repo,
+			// only a 401 of huggingface.co is trusted, the check failing otherwise or a mirror rejecting it says little about the token
+			if config.AuthToken != "" && config.ValidateToken {
+				username, err := hfd.WhoAmI(config.AuthToken)
+				switch {
+				case err == nil:
+					fmt.Fprintln(out, "Authenticated as:", username)
+				case errors.Is(err, hfd.ErrInvalidToken) && hfd.Endpoint == hfd.DefaultEndpoint:
+					return fmt.Errorf("token validation failed: %s", err)
+				default:
+					fmt.Fprintln(out, "WARNING: could not validate the token, continuing:", err)
 				}
 			}
 
-			fmt.Printf("Branch: %s\nStorage: %s\nNumberOfConcurrentConnections: %d\nAppend Filter Names to Folder: %t\nSkip SHA256 Check: %t\nToken: %s\n",
+			fmt.Fprintf(out, "Branch: %s\nStorage: %s\nNumberOfConcurrentConnections: %d\nAppend Filter Names to Folder: %t\nSkip SHA256 Check: %t\nToken: %s\n",
 				config.Branch, config.Storage, config.NumConnections, config.OneFolderPerFilter, config.SkipSHA, config.AuthToken)
 
+			hfd.NumSplits = config.NumSplits
+			hfd.RampUp = config.RampUp
+			hfd.MaxConnsPerHost = config.MaxConnsPerHost
+			hfd.ProbeRanges = config.ProbeRanges
+			hfd.PartDirs = nil
+			for _, dir := range config.PartDirs {
+				dir, err := expandPath(dir)
+				if err != nil {
+					return err
+				}
+				hfd.PartDirs = append(hfd.PartDirs, dir)
+			}
+			hfd.ShowPartProgress = config.ShowPartProgress
+			hfd.VerifyOverrides = config.VerifyOverrides
+			hfd.StrictFilters = config.StrictFilters
+			hfd.MatchFullPath = config.MatchFullPath
+			hfd.SplitSets = config.SplitSets
+			hfd.Files = config.Files
+			hfd.Includes = config.Includes
+			hfd.Excludes = config.Excludes
+			hfd.Layout = config.Layout
+			hfd.RouteRules = config.RouteRules
+			for _, route := range routes {
+				match, dir, found := strings.Cut(route, "=")
+				if !found || match == "" || dir == "" {
+					return fmt.Errorf("invalid route %q, use glob=folder, e.g. '*lora*=loras'", route)
+				}
+				if strings.HasPrefix(dir, "~") { // other relative folders are in the storage path
+					if dir, err = expandPath(dir); err != nil {
+						return err
+					}
+				}
+				hfd.RouteRules = append(hfd.RouteRules, hfd.RouteRule{Match: match, Dir: dir})
+			}
+			hfd.MaxDepth = config.MaxDepth
+			hfd.Prune = config.Prune
+			hfd.MaxTotalRetries = config.MaxTotalRetries
+			hfd.ScanConcurrency = config.ScanConcurrency
+			hfd.ScanRetries = scanRetries(config)
+			hfd.MaxBytesPerSec = 0
+			if config.MaxRate != "" {
+				maxRate, err := parseSize(config.MaxRate)
+				if err != nil {
+					return fmt.Errorf("invalid max rate: %s", err)
+				}
+				hfd.MaxBytesPerSec = maxRate
+			}
+			hfd.MaxBytesPerSecPerConn = 0
+			if config.MaxRatePerConn != "" {
+				maxRate, err := parseSize(config.MaxRatePerConn)
+				if err != nil {
+					return fmt.Errorf("invalid max rate per connection: %s", err)
+				}
+				hfd.MaxBytesPerSecPerConn = maxRate
+			}
+			if config.MinFreeSpace != "" {
+				minFree, err := parseSize(config.MinFreeSpace)
+				if err != nil {
+					return fmt.Errorf("invalid min free space: %s", err)
+				}
+				hfd.MinFreeBytes = uint64(minFree)
+			}
+			hfd.OnExistingDifferentSize = config.OnExistingDifferentSize
+			hfd.StopWhenFull = config.StopWhenFull
+			hfd.AllowEmpty = config.AllowEmpty
+			hfd.WriteManifest = config.WriteManifest
+			hfd.VerifyExisting = config.VerifyExisting
+			if config.OnlyMissing {
+				hfd.VerifyExisting = "off"
+			}
+			hfd.PruneDryRun = pruneDryRun
 			for i := 0; i < config.MaxRetries; i++ {
 				if err := hfd.DownloadModel(ModelOrDataSet, config.OneFolderPerFilter, config.SkipSHA, IsDataset, config.Storage, config.Branch, config.NumConnections, config.AuthToken, config.SilentMode); err != nil {
-					fmt.Printf("Warning: attempt %d / %d failed, error: %s\n", i+1, config.MaxRetries, err)
-					time.Sleep(time.Duration(config.RetryInterval) * time.Second)
+					if errors.Is(err, hfd.ErrTooManyRetries) || errors.Is(err, hfd.ErrNoFiles) {
+						return err
+					}
+					fmt.Fprintf(out, "Warning: attempt %d / %d failed, error: %s\n", i+1, config.MaxRetries, err)
+					if i+1 < config.MaxRetries {
+						if err := hfd.AddRetry(); err != nil {
+							return err
+						}
+					}
+					delay := time.Duration(config.RetryInterval) * time.Second
+					// rate limited, retrying sooner than asked only gets the ban extended
+					if requested := hfd.RetryDelay(err); requested > delay {
+						delay = requested
+						fmt.Fprintf(out, "Server asked to wait %s before retrying\n", delay.Round(time.Second))
+					}
+					time.Sleep(delay)
 					continue
 				}
-				fmt.Printf("\nDownload of %s completed successfully\n", ModelOrDataSet)
-				return nil
+				if i > 0 {
+					fmt.Fprintf(out, "\nDownload of %s completed successfully after %d retries\n", ModelOrDataSet, i)
+				} else {
+					fmt.Fprintf(out, "\nDownload of %s completed successfully\n", ModelOrDataSet)
+				}
+				return printPaths(pathsOut, config.PrintPaths)
 			}
 			return fmt.Errorf("failed to download %s after %d attempts", ModelOrDataSet, config.MaxRetries)
 		},
@@ -203,16 +393,54 @@ func main() {
 	rootCmd.PersistentFlags().StringVarP(&config.Branch, "branch", "b", config.Branch, "Branch of the model or dataset")
 	rootCmd.PersistentFlags().StringVarP(&config.Storage, "storage", "s", config.Storage, "Storage path for downloads")
 	rootCmd.PersistentFlags().IntVarP(&config.NumConnections, "concurrent", "c", config.NumConnections, "Number of concurrent connections")
+	rootCmd.PersistentFlags().IntVar(&config.NumSplits, "splits", config.NumSplits, "Number of parts each LFS file is split into, defaults to the number of concurrent connections")
+	rootCmd.PersistentFlags().BoolVar(&config.ProbeRanges, "probeRanges", config.ProbeRanges, "Download non-LFS files of 32MiB or more in parts when the server supports range requests (one HEAD request per such file)")
+	rootCmd.PersistentFlags().IntVar(&config.MaxConnsPerHost, "maxConnsPerHost", config.MaxConnsPerHost, "Cap the connections to any one host, parts wait for a free connection instead of failing (0 means no cap)")
+	rootCmd.PersistentFlags().BoolVar(&config.RampUp, "rampUp", config.RampUp, "Open the connections of a file one every 100ms instead of all at once")
+	rootCmd.PersistentFlags().StringSliceVar(&config.PartDirs, "partDir", config.PartDirs, "Spread the parts of LFS downloads round-robin over these folders, e.g. on different disks (repeatable)")
 	rootCmd.PersistentFlags().StringVarP(&config.AuthToken, "token", "t", config.AuthToken, "HuggingFace Auth Token")
 	rootCmd.PersistentFlags().BoolVarP(&config.OneFolderPerFilter, "appendFilterFolder", "f", config.OneFolderPerFilter, "Append filter name to folder")
+	rootCmd.PersistentFlags().StringVar(&config.Layout, "layout", config.Layout, "Storage layout, empty for <owner>_<repo>/<path>, filter-flat for <storage>/<filter>/<file name> (needs filters), or hub for the huggingface_hub cache layout (models--<owner>--<repo>/snapshots/<commit>/<path>)")
+	rootCmd.PersistentFlags().StringArrayVar(&routes, "route", nil, "Put the files matching a glob in their own folder, e.g. --route '*lora*=loras' (relative to the storage path, repeatable, first match wins)")
+	rootCmd.PersistentFlags().IntVar(&config.MaxDepth, "maxDepth", config.MaxDepth, "Only download files up to this folder depth, root files are at depth 0 (0 means unlimited)")
+	rootCmd.PersistentFlags().BoolVar(&config.MatchFullPath, "matchFullPath", config.MatchFullPath, "Match the filters without a \"/\" against the whole repo path, folders included, instead of only the file name")
+	rootCmd.PersistentFlags().BoolVar(&config.StrictFilters, "strictFilters", config.StrictFilters, "Apply the filters to all files, not only LFS files, so configs not matching a filter are skipped too")
+	rootCmd.PersistentFlags().StringSliceVar(&config.Files, "files", config.Files, "Download only these exact repo paths, e.g. --files unet/model.safetensors, filters are ignored and a missing path is an error")
+	rootCmd.PersistentFlags().StringSliceVar(&config.Includes, "include", config.Includes, "Download only the files whose repo path matches one of these globs, e.g. --include 'onnx/*' --include config.json, added to --files and intersected with the filters")
+	rootCmd.PersistentFlags().StringSliceVarP(&config.Excludes, "exclude", "E", config.Excludes, "Never download the files matching one of these patterns, same syntax as the filters, e.g. -E '*.onnx' -E 'original/', applied before the filters")
+	rootCmd.PersistentFlags().BoolVar(&config.SplitSets, "splitSets", config.SplitSets, "Download all the files of a split set (model-00001-of-00003.gguf, .gguf-split-a, .z01, .part1, .001) when the filters select one of them")
 	rootCmd.PersistentFlags().BoolVarP(&config.SkipSHA, "skipSHA", "k", config.SkipSHA, "Skip SHA256 hash check")
 	rootCmd.PersistentFlags().IntVar(&config.MaxRetries, "maxRetries", config.MaxRetries, "Maximum number of retries for downloads")
 	rootCmd.PersistentFlags().IntVar(&config.RetryInterval, "retryInterval", config.RetryInterval, "Interval between retries in seconds")
+	rootCmd.PersistentFlags().IntVar(&config.MaxTotalRetries, "maxTotalRetries", config.MaxTotalRetries, "Abort once this many retries happened in total, file list requests and download attempts together (0 means no limit)")
+	rootCmd.PersistentFlags().IntVar(&config.ScanRetries, "scanRetries", config.ScanRetries, "Attempts for each repo tree (file list) request, defaults to --maxRetries")
+	rootCmd.PersistentFlags().IntVar(&config.ScanConcurrency, "scanConcurrency", config.ScanConcurrency, "Repo folders listed at once before downloading, for repos with many folders, 0 uses the number of connections, 1 lists each folder when it is reached")
 	rootCmd.PersistentFlags().BoolVarP(&justDownload, "justDownload", "j", config.JustDownload, "Just download the model to the current directory and assume the first argument is the model name")
 	rootCmd.Flags().BoolVarP(&install, "install", "i", false, "Install the binary to the OS default bin folder, Unix-like operating systems only")
 
 	rootCmd.Flags().StringVarP(&installPath, "installPath", "p", "/usr/local/bin/", "install Path (optional)")
 	rootCmd.PersistentFlags().BoolVarP(&config.SilentMode, "silentMode", "q", config.SilentMode, "Disable progress bar output printing")
+	rootCmd.PersistentFlags().Var(&config.VerifyOverrides, "verifyOverride", "Force a verification mode per file glob, e.g. --verifyOverride '*.json=sha256' (modes: sha256, size, etag, repeatable, first match wins)")
+	rootCmd.PersistentFlags().StringVar(&config.OnExistingDifferentSize, "onExistingDifferentSize", config.OnExistingDifferentSize, "What to do with an existing file whose size differs from the repo: redownload, resume, skip or error")
+	rootCmd.PersistentFlags().StringVar(&config.VerifyExisting, "verifyExisting", config.VerifyExisting, "How existing files of the right size are checked before being skipped: lfs (hash LFS files), all (hash every file) or off (size only)")
+	rootCmd.PersistentFlags().BoolVar(&config.OnlyMissing, "onlyMissing", config.OnlyMissing, "Fastest top up run: existing files of the right size are kept without any hashing, only missing files are downloaded (same as --verifyExisting off)")
+	rootCmd.PersistentFlags().StringVar(&config.Endpoint, "endpoint", config.Endpoint, "Hugging Face host to download from, e.g. https://hf-mirror.com, defaults to env HF_ENDPOINT or https://huggingface.co")
+	rootCmd.PersistentFlags().StringVar(&config.CACertFile, "cacert", config.CACertFile, "PEM file of extra root CAs to trust, for mirrors using an internal CA")
+	rootCmd.PersistentFlags().BoolVar(&config.Insecure, "insecure", config.Insecure, "Disable TLS certificate verification (testing only)")
+	rootCmd.PersistentFlags().StringSliceVar(&config.InsecureHosts, "insecureHost", config.InsecureHosts, "Disable TLS certificate verification for this host only, e.g. a mirror with a self-signed certificate (repeatable)")
+	rootCmd.PersistentFlags().StringVar(&config.MaxRate, "maxRate", config.MaxRate, "Cap the total download speed of all connections together, in bytes per second, e.g. 5MiB")
+	rootCmd.PersistentFlags().StringVar(&config.MaxRatePerConn, "maxRatePerConn", config.MaxRatePerConn, "Cap the download speed of each connection, in bytes per second, e.g. 1MiB, the more restrictive of this and --maxRate applies")
+	rootCmd.PersistentFlags().StringVar(&config.MinFreeSpace, "minFreeSpace", config.MinFreeSpace, "Pause before the next file while free disk space is below this size (e.g. 10GiB), and abort if it does not recover")
+	rootCmd.PersistentFlags().BoolVar(&config.StopWhenFull, "stopWhenFull", config.StopWhenFull, "Download files in order until the next one would not fit on the disk, then stop cleanly and list the files left out")
+	rootCmd.PersistentFlags().BoolVar(&config.WriteManifest, "writeManifest", config.WriteManifest, "Once done, write <owner>_<name>"+hfd.ManifestFileName+" in the storage path, listing each file with its size and sha256, for offline checks with verify --manifest")
+	rootCmd.PersistentFlags().BoolVar(&config.AllowEmpty, "allowEmpty", config.AllowEmpty, "Succeed even when the repo, branch and filters select no file at all")
+	rootCmd.PersistentFlags().BoolVar(&config.Prune, "prune", config.Prune, "Delete local files that are no longer present in the repo")
+	rootCmd.PersistentFlags().BoolVar(&pruneDryRun, "pruneDryRun", false, "Print the local files that --prune would delete, without deleting them")
+	rootCmd.PersistentFlags().BoolVar(&config.ValidateToken, "validateToken", config.ValidateToken, "Validate the token before downloading, use --validateToken=false to disable")
+	rootCmd.PersistentFlags().StringVar(&config.Progress, "progress", config.Progress, "Progress output: bar, or none to print nothing at all (only the exit code and error are reported)")
+	rootCmd.PersistentFlags().StringVar(&config.PrintPaths, "printPaths", config.PrintPaths, "Once done, print the local path of each downloaded file to stdout, progress goes to stderr: downloaded, all (up to date files too) or json")
+	rootCmd.PersistentFlags().Lookup("printPaths").NoOptDefVal = "downloaded"
+	rootCmd.PersistentFlags().BoolVar(&config.ShowPartProgress, "partProgress", config.ShowPartProgress, "Show the progress of each part of multi-threaded downloads")
 
 	// Add the generate-config command
 	generateCmd := &cobra.Command{
@@ -225,11 +453,382 @@ func main() {
 
 	rootCmd.AddCommand(generateCmd)
 
+	// Add the doctor command
+	doctorCmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Checks connectivity, token, storage permissions and disk space",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			config.Storage, err = expandPath(config.Storage)
+			if err != nil {
+				return err
+			}
+			applyTLSSettings(config)
+			return runDoctor(config)
+		},
+	}
+
+	rootCmd.AddCommand(doctorCmd)
+
+	// Add the cache command, only scan for now
+	var scanJSON bool
+	cacheCmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Inspects the downloads in the storage path",
+	}
+	cacheScanCmd := &cobra.Command{
+		Use:   "scan",
+		Short: "Reports disk usage, file count and incomplete downloads per repo, largest first",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			storage, err := expandPath(config.Storage)
+			if err != nil {
+				return err
+			}
+			return runCacheScan(storage, scanJSON)
+		},
+	}
+	cacheScanCmd.Flags().BoolVar(&scanJSON, "json", false, "Print the report as JSON")
+	cacheCmd.AddCommand(cacheScanCmd)
+	rootCmd.AddCommand(cacheCmd)
+
+	// Add the clean command
+	var cleanMinAge time.Duration
+	cleanCmd := &cobra.Command{
+		Use:   "clean REPO",
+		Short: "Deletes the parts left by interrupted downloads of a repo, in its folders of the storage path",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			storage, err := expandPath(config.Storage)
+			if err != nil {
+				return err
+			}
+			return runClean(storage, args[0], cleanMinAge)
+		},
+	}
+	cleanCmd.Flags().DurationVar(&cleanMinAge, "minAge", 10*time.Minute, "Keep the parts of a file modified more recently than this, a download may still be running")
+	rootCmd.AddCommand(cleanCmd)
+
+	// Add the verify command
+	var verifyFix, verifyManifest bool
+	verifyCmd := &cobra.Command{
+		Use:   "verify REPO",
+		Short: "Checks the downloaded files of a repo against its file list, without downloading, and reports OK, MISSING or CORRUPT per file",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var err error
+			config.Storage, err = expandPath(config.Storage)
+			if err != nil {
+				return err
+			}
+			repo := applyRevision(args[0], config, cmd.Flags().Changed("branch"))
+			applyTLSSettings(config)
+			return runVerify(config, repo, verifyFix, verifyManifest)
+		},
+	}
+	verifyCmd.Flags().BoolVar(&verifyFix, "fix", false, "Download again the missing and corrupt files only")
+	verifyCmd.Flags().BoolVar(&verifyManifest, "manifest", false, "Check the files listed in the manifest written by --writeManifest, without any network call")
+	rootCmd.AddCommand(verifyCmd)
+
+	// Add the ls command
+	var listDataset, listJSON bool
+	listCmd := &cobra.Command{
+		Use:     "ls REPO",
+		Aliases: []string{"list"},
+		Short:   "Prints the files a download of the repo would select as a tree, with sizes, without downloading anything",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			repo := applyRevision(args[0], config, cmd.Flags().Changed("branch"))
+			applyTLSSettings(config)
+			return runList(config, repo, listDataset, listJSON)
+		},
+	}
+	listCmd.Flags().BoolVar(&listDataset, "dataset", false, "The repo is a dataset, skipping the detection")
+	listCmd.Flags().BoolVar(&listJSON, "json", false, "Print the files as JSON")
+	rootCmd.AddCommand(listCmd)
+
 	if err := rootCmd.Execute(); err != nil {
 		log.Fatalln("Error:", err)
 	}
 }
 
+// expandPath expands a leading ~ or ~user to the home directory, and returns the cleaned absolute path
+func expandPath(p string) (string, error) {
+	if strings.HasPrefix(p, "~") {
+		name, rest := p[1:], ""
+		if i := strings.IndexAny(name, "/"+string(filepath.Separator)); i >= 0 {
+			name, rest = name[:i], name[i+1:]
+		}
+		var homeDir string
+		if name == "" {
+			dir, err := os.UserHomeDir()
+			if err != nil {
+				return "", err
+			}
+			homeDir = dir
+		} else {
+			u, err := user.Lookup(name)
+			if err != nil {
+				return "", err
+			}
+			homeDir = u.HomeDir
+		}
+		p = filepath.Join(homeDir, rest)
+	}
+	return filepath.Abs(p)
+}
+
+// printPaths writes the local paths of the files of the download, one per line or as JSON
+func printPaths(w io.Writer, mode string) error {
+	downloaded, upToDate := hfd.LocalFiles()
+	for i := range downloaded {
+		downloaded[i] = filepath.FromSlash(downloaded[i])
+	}
+	for i := range upToDate {
+		upToDate[i] = filepath.FromSlash(upToDate[i])
+	}
+	switch mode {
+	case "downloaded":
+		for _, p := range downloaded {
+			fmt.Fprintln(w, p)
+		}
+	case "all":
+		for _, p := range append(downloaded, upToDate...) {
+			fmt.Fprintln(w, p)
+		}
+	case "json":
+		if downloaded == nil {
+			downloaded = []string{}
+		}
+		if upToDate == nil {
+			upToDate = []string{}
+		}
+		return json.NewEncoder(w).Encode(map[string][]string{"downloaded": downloaded, "up_to_date": upToDate})
+	}
+	return nil
+}
+
+// applyRevision moves the revision of a repo spec into config.Branch and returns the spec without it,
+// a revision given with owner/name@rev is used unless -b is set too, -b wins
+func applyRevision(spec string, config *Config, branchSet bool) string {
+	repo, revision := splitRevision(spec)
+	if revision != "" && !branchSet {
+		config.Branch = revision
+	}
+	return repo
+}
+
+// splitRevision takes the revision out of a repo spec, "owner/name@rev:filters" gives "owner/name:filters" and "rev",
+// only the part before the filters is looked at, so an @ in a filter is kept
+func splitRevision(spec string) (string, string) {
+	repo, filters, hasFilters := strings.Cut(spec, ":")
+	repo, revision, found := strings.Cut(repo, "@")
+	if !found {
+		return spec, ""
+	}
+	if hasFilters {
+		return repo + ":" + filters, revision
+	}
+	return repo, revision
+}
+
+// scanRetries returns the attempts for each tree request: --scanRetries, else --maxRetries, at least one
+func scanRetries(config *Config) int {
+	retries := config.ScanRetries
+	if retries <= 0 {
+		retries = config.MaxRetries
+	}
+	if retries <= 0 {
+		retries = 1
+	}
+	return retries
+}
+
+// applyTLSSettings passes the endpoint and TLS options to the downloader, warning loudly when verification is disabled
+func applyTLSSettings(config *Config) {
+	hfd.Endpoint = config.Endpoint
+	if hfd.Endpoint == "" {
+		hfd.Endpoint = os.Getenv("HF_ENDPOINT")
+	}
+	if hfd.Endpoint == "" {
+		hfd.Endpoint = hfd.DefaultEndpoint
+	}
+	hfd.CACertFile = config.CACertFile
+	hfd.InsecureSkipVerify = config.Insecure
+	hfd.InsecureHosts = config.InsecureHosts
+	if config.Insecure {
+		fmt.Fprintln(os.Stderr, "WARNING: TLS certificate verification is disabled (--insecure), connections can be intercepted, only use this for testing")
+	} else if len(config.InsecureHosts) > 0 {
+		fmt.Fprintln(os.Stderr, "WARNING: TLS certificate verification is disabled for:", strings.Join(config.InsecureHosts, ", "))
+	}
+}
+
+// parseSize parses human written sizes like "1024", "500M", "1.5 GiB" or "2tb", units are case insensitive,
+// KB/MB/GB/TB/PB are powers of 1000 while K/M/G/T/P and KiB/MiB/GiB/TiB/PiB are powers of 1024
+func parseSize(s string) (int64, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	number := strings.TrimRight(value, "abcdefghijklmnopqrstuvwxyz")
+	unit := strings.TrimSpace(value[len(number):])
+	number = strings.TrimSpace(number)
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	base := 1024.0
+	if len(unit) == 2 && unit[1] == 'b' {
+		base = 1000
+	}
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "b"), "i")
+	multiplier := 1.0
+	switch unit {
+	case "":
+	case "k":
+		multiplier = base
+	case "m":
+		multiplier = base * base
+	case "g":
+		multiplier = base * base * base
+	case "t":
+		multiplier = base * base * base * base
+	case "p":
+		multiplier = base * base * base * base * base
+	default:
+		return 0, fmt.Errorf("invalid size unit in %q", s)
+	}
+	return int64(n * multiplier), nil
+}
+
+// verifyOverridesFlag reads repeated glob=mode flags into ordered overrides, after the ones of the config file
+type verifyOverridesFlag []hfd.VerifyOverride
+
+func (f *verifyOverridesFlag) Set(value string) error {
+	match, mode, found := strings.Cut(value, "=")
+	if !found || match == "" || mode == "" {
+		return fmt.Errorf("invalid verify override %q, use glob=mode, e.g. '*.json=sha256'", value)
+	}
+	*f = append(*f, hfd.VerifyOverride{Match: match, Mode: mode})
+	return nil
+}
+
+func (f *verifyOverridesFlag) String() string {
+	specs := make([]string, len(*f))
+	for i, override := range *f {
+		specs[i] = override.Match + "=" + override.Mode
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *verifyOverridesFlag) Type() string { return "glob=mode" }
+
+// UnmarshalJSON reads a list of {"match", "mode"} objects, or the older {"glob": "mode"} object, keeping the order of its keys as written
+func (f *verifyOverridesFlag) UnmarshalJSON(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+		return json.Unmarshal(data, (*[]hfd.VerifyOverride)(f))
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if _, err := dec.Token(); err != nil { // the opening brace
+		return err
+	}
+	*f = nil
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		var mode string
+		if err := dec.Decode(&mode); err != nil {
+			return err
+		}
+		*f = append(*f, hfd.VerifyOverride{Match: key.(string), Mode: mode})
+	}
+	return nil
+}
+
+// loadToken resolves the token from the environment and the huggingface-cli token files, see hfd.LoadToken,
+// warning on out when it comes from the deprecated HUGGING_FACE_HUB_TOKEN variable
+func loadToken(out io.Writer) (string, error) {
+	hfd.AuthToken = "" // only called without a config token, a previous run must not leak into this one
+	token, err := hfd.LoadToken()
+	if token != "" && os.Getenv("HF_TOKEN") == "" && token == strings.TrimSpace(os.Getenv("HUGGING_FACE_HUB_TOKEN")) {
+		fmt.Fprintln(out, "DeprecationWarning: The environment variable 'HUGGING_FACE_HUB_TOKEN' is deprecated and will be removed in a future version. Please use 'HF_TOKEN' instead.")
+	}
+	return token, err
+}
+
+// runDoctor prints a pass/fail checklist of the things that usually break a download
+func runDoctor(config *Config) error {
+	failed := 0
+	check := func(name string, err error, hint string) {
+		if err != nil {
+			failed++
+			fmt.Printf("[FAIL] %s: %s\n       hint: %s\n", name, err, hint)
+			return
+		}
+		fmt.Printf("[ OK ] %s\n", name)
+	}
+
+	// any http response, even 401, means the endpoint is reachable
+	client, err := hfd.NewHTTPClient()
+	if err == nil {
+		client.Timeout = 15 * time.Second
+		var resp *http.Response
+		resp, err = client.Get(hfd.EndpointURL(hfd.WhoAmIURL))
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+	check("Network reachability to "+hfd.Endpoint, err, "check your internet connection, firewall or proxy settings")
+
+	token := config.AuthToken
+	if token == "" {
+		if token, err = loadToken(io.Discard); err != nil {
+			check("Token file", err, "check the permissions of the huggingface token file, or pass the token using -t or HF_TOKEN")
+		}
+	}
+	if token == "" {
+		fmt.Println("[SKIP] Token validity: no token set, gated and private repos will not be accessible")
+	} else {
+		username, err := hfd.WhoAmI(token)
+		if err == nil {
+			fmt.Printf("       authenticated as: %s\n", username)
+		}
+		check("Token validity", err, "generate a new access token at https://huggingface.co/settings/tokens and pass it using -t or HF_TOKEN")
+	}
+
+	err = os.MkdirAll(config.Storage, os.ModePerm)
+	if err == nil {
+		var f *os.File
+		f, err = os.CreateTemp(config.Storage, ".hfdownloader-doctor-*")
+		if err == nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+	check(fmt.Sprintf("Write permission on storage path: %s", config.Storage), err, "choose another storage path using -s, or fix the folder permissions")
+
+	free, err := hfd.FreeDiskSpace(config.Storage)
+	if err == nil {
+		fmt.Printf("       available: %.2f GB\n", float64(free)/(1024*1024*1024))
+	}
+	check("Free disk space on storage path", err, "make sure the storage path exists and is on a mounted volume")
+
+	fmt.Println("Proxy and TLS environment:")
+	for _, name := range []string{"HTTPS_PROXY", "HTTP_PROXY", "NO_PROXY", "SSL_CERT_FILE", "SSL_CERT_DIR"} {
+		value := os.Getenv(name)
+		if value == "" {
+			value = os.Getenv(strings.ToLower(name))
+		}
+		if value == "" {
+			value = "(not set)"
+		}
+		fmt.Printf("       %s: %s\n", name, value)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
+
 func installBinary(installPath string) error {
 	if runtime.GOOS == "windows" {
 		return errors.New("the install command is not supported on Windows")
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	hfd "github.com/bodaay/HuggingFaceModelDownloader/hfdownloader"
+)
+
+func TestVerifyOverridesConfig(t *testing.T) {
+	want := verifyOverridesFlag{{Match: "*.json", Mode: "etag"}, {Match: "config.*", Mode: "sha256"}}
+	for _, input := range []string{
+		`{"verify_overrides": [{"match": "*.json", "mode": "etag"}, {"match": "config.*", "mode": "sha256"}]}`,
+		`{"verify_overrides": {"*.json": "etag", "config.*": "sha256"}}`, // older format, key order kept
+	} {
+		var config Config
+		if err := json.Unmarshal([]byte(input), &config); err != nil {
+			t.Fatalf("%s: %v", input, err)
+		}
+		if !reflect.DeepEqual(config.VerifyOverrides, want) {
+			t.Errorf("%s: got %v, want %v", input, config.VerifyOverrides, want)
+		}
+	}
+
+	var flag verifyOverridesFlag
+	for _, value := range []string{"*.json=etag", "config.*=sha256"} {
+		if err := flag.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual([]hfd.VerifyOverride(flag), []hfd.VerifyOverride(want)) {
+		t.Errorf("flags: got %v, want %v", flag, want)
+	}
+	if err := flag.Set("*.json"); err == nil {
+		t.Error("a value without a mode should be rejected")
+	}
+}
+
+func TestDefaultsAgree(t *testing.T) {
+	readme, err := os.ReadFile("README.md")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	tests := []struct {
+		flag    string // as in its README bullet
+		config  any
+		library any // nil when the library has no such setting
+	}{
+		{"-c, --concurrent int", config.NumConnections, hfd.NumConnections},
+		{"--onExistingDifferentSize string", config.OnExistingDifferentSize, hfd.OnExistingDifferentSize},
+		{"--verifyExisting string", config.VerifyExisting, hfd.VerifyExisting},
+		{"--maxRetries int", config.MaxRetries, nil}, // hfd.ScanRetries is a different setting
+		{"--retryInterval int", config.RetryInterval, nil},
+		{"-s, --storage string", config.Storage, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.flag, func(t *testing.T) {
+			if tt.library != nil && tt.config != tt.library {
+				t.Errorf("config default %v, library default %v", tt.config, tt.library)
+			}
+			documented := fmt.Sprintf("default %v", tt.config)
+			if _, ok := tt.config.(string); ok {
+				documented = fmt.Sprintf("default %q", tt.config)
+			}
+			_, bullet, found := strings.Cut(string(readme), "- `"+tt.flag+"`")
+			bullet, _, _ = strings.Cut(bullet, "\n")
+			if !found || !strings.Contains(bullet, documented) {
+				t.Errorf("README bullet does not say %s", documented)
+			}
+		})
+	}
+}
+
+func TestApplyRevision(t *testing.T) {
+	tests := []struct {
+		spec       string
+		branch     string // set with -b, empty when not given
+		wantRepo   string
+		wantBranch string
+	}{
+		{"o/r", "", "o/r", "main"},
+		{"o/r", "dev", "o/r", "dev"},
+		{"o/r@v2", "", "o/r", "v2"},
+		{"o/r@v2", "dev", "o/r", "dev"},
+		{"o/r:q4_0", "", "o/r:q4_0", "main"},
+		{"o/r:q4_0", "dev", "o/r:q4_0", "dev"},
+		{"o/r@v2:q4_0,q5_0", "", "o/r:q4_0,q5_0", "v2"},
+		{"o/r@v2:q4_0", "dev", "o/r:q4_0", "dev"},
+		{"o/r:q4@0", "", "o/r:q4@0", "main"}, // an @ in a filter is not a revision
+		{"o/r@v2:q4@0", "", "o/r:q4@0", "v2"},
+		{"o/r@", "", "o/r", "main"}, // an empty revision keeps the branch
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec+" -b "+tt.branch, func(t *testing.T) {
+			config := DefaultConfig()
+			if tt.branch != "" {
+				config.Branch = tt.branch
+			}
+			repo := applyRevision(tt.spec, &config, tt.branch != "")
+			if repo != tt.wantRepo || config.Branch != tt.wantBranch {
+				t.Errorf("got %q on branch %q, want %q on branch %q", repo, config.Branch, tt.wantRepo, tt.wantBranch)
+			}
+		})
+	}
+}
+
+func TestRunClean(t *testing.T) {
+	storage := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	files := map[string]bool{ // kept or not
+		"o_r/tmp/model.bin_0.tmp":          false,
+		"o_r/tmp/model.bin.etag":           false,
+		"o_r/sub/tmp/model.bin_12.tmp":     false,
+		"o_r/config.json":                  true,
+		"o_r/data/tmp/notes.tmp":           true, // a repo folder named tmp, without parts
+		"o_r/data/tmp/config.json":         true,
+		"o_r_f_q4/tmp/model.q4.gguf_3.tmp": false,
+		"other_r/tmp/model.bin_0.tmp":      true,
+	}
+	for name := range files {
+		p := filepath.Join(storage, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(p, old, old)
+	}
+	if err := runClean(storage, "o/r", 10*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for name, kept := range files {
+		if _, err := os.Stat(filepath.Join(storage, name)); (err == nil) != kept {
+			t.Errorf("%s: kept %t, want %t", name, err == nil, kept)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(storage, "o_r", "tmp")); !os.IsNotExist(err) {
+		t.Errorf("the emptied tmp folder was kept: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	hfd "github.com/bodaay/HuggingFaceModelDownloader/hfdownloader"
+)
+
+// runVerify checks the local copy of a repo, prints a status line per file and, with fix, downloads again the failing files only.
+// With fromManifest the files listed in the manifest of the repo are checked, without any network call
+func runVerify(config *Config, repo string, fix bool, fromManifest bool) error {
+	token := config.AuthToken
+	if token == "" {
+		var err error
+		if token, err = loadToken(os.Stdout); err != nil {
+			return err
+		}
+	}
+
+	hfd.StrictFilters = config.StrictFilters
+	hfd.MatchFullPath = config.MatchFullPath
+	hfd.Files = config.Files
+	hfd.Includes = config.Includes
+	hfd.Excludes = config.Excludes
+	hfd.RouteRules = config.RouteRules
+	hfd.VerifyOverrides = config.VerifyOverrides
+	hfd.MaxDepth = config.MaxDepth
+	hfd.ScanRetries = scanRetries(config)
+	var results []hfd.VerifyResult
+	var isDataset, detected bool
+	var err error
+	if fromManifest {
+		results, err = hfd.VerifyManifest(hfd.ManifestPath(config.Storage, repo))
+	} else {
+		if isDataset, err = hfd.DetectDataset(repo, config.Branch, token); err != nil {
+			return err
+		}
+		detected = true
+		results, err = hfd.VerifyModel(repo, config.SkipSHA, isDataset, config.Storage, config.Branch, token, true)
+	}
+	if err != nil {
+		return err
+	}
+
+	var failing []string
+	fmt.Printf("%-8s %s\n", "STATUS", "FILE")
+	for _, r := range results {
+		line := fmt.Sprintf("%-8s %s", r.Status, r.Path)
+		if r.Reason != "" {
+			line += " (" + r.Reason + ")"
+		}
+		fmt.Println(line)
+		if r.Status != "OK" {
+			failing = append(failing, r.Path)
+		}
+	}
+	fmt.Printf("\n%d files, %d OK, %d failed\n", len(results), len(results)-len(failing), len(failing))
+	if len(failing) == 0 {
+		return nil
+	}
+	if !fix {
+		return fmt.Errorf("%d files failed verification, use --fix to download them again", len(failing))
+	}
+
+	if !detected {
+		if isDataset, err = hfd.DetectDataset(repo, config.Branch, token); err != nil {
+			return err
+		}
+	}
+	// only the failing files, hashed again once on disk, the others were just checked
+	hfd.Files = failing
+	hfd.VerifyExisting = "all"
+	return hfd.DownloadModel(repo, false, config.SkipSHA, isDataset, config.Storage, config.Branch, config.NumConnections, token, config.SilentMode)
+}